@@ -2,26 +2,43 @@ package api
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"encoding/base64"
+	"errors"
+	"fmt"
 	"geo-distributed-message-broker/config"
 	"geo-distributed-message-broker/data"
+	"geo-distributed-message-broker/models"
 	"geo-distributed-message-broker/pb"
 	"geo-distributed-message-broker/services"
+	"io"
 	"log/slog"
 	"net"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/grpc-ecosystem/go-grpc-middleware/v2/interceptors/auth"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
 	"google.golang.org/grpc/status"
 )
 
-func NewBrokerServer(cfg config.Config, broker services.BrokerService, consensus services.ConsensusService) (*grpc.Server, net.Listener, error) {
+func NewBrokerServer(cfg config.Config, broker services.BrokerService, consensus services.ConsensusService, retention services.RetentionService, peers *services.PeerVerifier, authService services.AuthService) (*grpc.Server, net.Listener, error) {
 	slog.Info("Creating new broker server 🌐")
 
 	srv := &brokerServer{
-		broker:    broker,
-		consensus: consensus,
+		broker:         broker,
+		consensus:      consensus,
+		retention:      retention,
+		peers:          peers,
+		publishSlots:   make(chan struct{}, cfg.MaxInflightPublishes),
+		publishTimeout: cfg.PublishTimeout,
 	}
 
 	listener, err := net.Listen("tcp", cfg.BrokerPort)
@@ -29,12 +46,24 @@ func NewBrokerServer(cfg config.Config, broker services.BrokerService, consensus
 		return nil, nil, err
 	}
 
-	authFunc := newAuthFunc(cfg)
+	authFunc := newAuthFunc(authService)
 
-	grpcSrv := grpc.NewServer(
+	opts := []grpc.ServerOption{
 		grpc.UnaryInterceptor(auth.UnaryServerInterceptor(authFunc)),
 		grpc.StreamInterceptor(auth.StreamServerInterceptor(authFunc)),
-	)
+	}
+
+	if cfg.BrokerTLS {
+		conf, err := newBrokerTLSConfig(cfg)
+		if err != nil {
+			listener.Close()
+			return nil, nil, err
+		}
+
+		opts = append(opts, grpc.Creds(credentials.NewTLS(conf)))
+	}
+
+	grpcSrv := grpc.NewServer(opts...)
 
 	pb.RegisterBrokerServer(grpcSrv, srv)
 
@@ -45,17 +74,29 @@ type brokerServer struct {
 	pb.UnsafeBrokerServer
 	broker    services.BrokerService
 	consensus services.ConsensusService
+	retention services.RetentionService
+	peers     *services.PeerVerifier
+
+	publishSlots   chan struct{} // limits consensus rounds in flight for publish streams
+	publishTimeout time.Duration
 }
 
 func (s *brokerServer) Publish(ctx context.Context, req *pb.PublishRequest) (*pb.PublishResponse, error) {
-	msg := data.Message{
-		Topic: req.Topic,
-		Body:  req.Body,
+	msg, err := newMessage(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := authorizePublish(ctx, msg.Topic); err != nil {
+		return nil, err
 	}
 
-	id, err := s.consensus.Publish(msg)
+	ctx, cancel := context.WithTimeout(ctx, s.publishTimeout)
+	defer cancel()
+
+	id, err := s.consensus.Publish(ctx, msg)
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "failed to publish: %v", err)
+		return nil, publishError(ctx, "failed to publish: %v", err)
 	}
 
 	rsp := &pb.PublishResponse{
@@ -65,8 +106,107 @@ func (s *brokerServer) Publish(ctx context.Context, req *pb.PublishRequest) (*pb
 	return rsp, nil
 }
 
+func (s *brokerServer) PublishBatch(ctx context.Context, req *pb.PublishBatchRequest) (*pb.PublishBatchResponse, error) {
+	if len(req.Messages) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "batch must not be empty")
+	}
+
+	msgs := make([]data.Message, 0, len(req.Messages))
+	for _, m := range req.Messages {
+		msg, err := newMessage(m)
+		if err != nil {
+			return nil, err
+		}
+
+		if err := authorizePublish(ctx, msg.Topic); err != nil {
+			return nil, err
+		}
+
+		msgs = append(msgs, msg)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, s.publishTimeout)
+	defer cancel()
+
+	ids, err := s.consensus.PublishBatch(ctx, msgs)
+	if err != nil {
+		return nil, publishError(ctx, "failed to publish batch: %v", err)
+	}
+
+	rsp := &pb.PublishBatchResponse{
+		Ids: ids,
+	}
+
+	return rsp, nil
+}
+
+func (s *brokerServer) PublishStream(srv pb.Broker_PublishStreamServer) error {
+	var wg sync.WaitGroup
+	var sendMu sync.Mutex // protects srv.Send
+	defer wg.Wait()
+
+	for {
+		req, err := srv.Recv()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// Wait for a free consensus round before reading the next message,
+		// so producers are slowed down by gRPC flow control
+		select {
+		case s.publishSlots <- struct{}{}:
+		case <-srv.Context().Done():
+			return nil
+		}
+
+		wg.Add(1)
+		go func(req *pb.PublishStreamRequest) {
+			defer wg.Done()
+
+			rsp := &pb.PublishStreamResponse{
+				Sequence: req.Sequence,
+			}
+
+			ctx, cancel := context.WithTimeout(srv.Context(), s.publishTimeout)
+			defer cancel()
+
+			msg, err := newMessage(req.Message)
+			if err == nil {
+				err = authorizePublish(ctx, msg.Topic)
+			}
+			if err == nil {
+				rsp.Id, err = s.consensus.Publish(ctx, msg)
+			}
+			<-s.publishSlots
+
+			if err != nil {
+				rsp.Error = status.Convert(err).Message()
+			}
+
+			sendMu.Lock()
+			defer sendMu.Unlock()
+			if err := srv.Send(rsp); err != nil {
+				slog.Error("Failed to send publish confirmation", "sequence", req.Sequence, "error", err.Error())
+			}
+		}(req)
+	}
+}
+
 func (s *brokerServer) Subscribe(req *pb.SubscribeRequest, srv pb.Broker_SubscribeServer) error {
-	ch, subscriberID, err := s.broker.Subscribe(req.Topics)
+	subscribeReq := models.ToSubscribeRequest(req)
+	if err := validateFilters(subscribeReq.Filters); err != nil {
+		return err
+	}
+
+	subscribeReq, err := s.resume(srv.Context(), subscribeReq)
+	if err != nil {
+		return err
+	}
+
+	ch, subscriberID, err := s.broker.Subscribe(srv.Context(), subscribeReq)
 	if err != nil {
 		slog.Error("Failed to subscribe", "subscriber", subscriberID, "error", err.Error())
 		return status.Errorf(codes.Internal, "failed to subscribe: %v", err)
@@ -75,44 +215,449 @@ func (s *brokerServer) Subscribe(req *pb.SubscribeRequest, srv pb.Broker_Subscri
 	for {
 		select {
 		case msg := <-ch:
-			if timestamp, ok := req.Topics[msg.Topic]; !ok || msg.Timestamp < timestamp {
-				slog.Warn("Skipping message", "subscriber", subscriberID, "message", msg.ID)
-				continue
+			rsp := &pb.MessageResponse{
+				Id:        msg.ID,
+				Timestamp: msg.Timestamp,
+				Topic:     msg.Topic,
+				Key:       msg.Key,
+				Body:      msg.Body,
+				Headers:   msg.Headers,
+			}
+
+			if err := srv.Send(rsp); err != nil {
+				slog.Error("Failed to send message", "subscriber", subscriberID, "error", err.Error())
+				s.broker.Unsubscribe(subscriberID)
+				return status.Errorf(codes.Internal, "failed to send message: %v", err)
 			}
 
+		case <-srv.Context().Done():
+			s.broker.Unsubscribe(subscriberID)
+			return nil
+		}
+	}
+}
+
+func (s *brokerServer) SubscribeWithAck(srv pb.Broker_SubscribeWithAckServer) error {
+	// First request must open the subscription
+	req, err := srv.Recv()
+	if err != nil {
+		return err
+	}
+
+	if req.GetSubscribe() == nil {
+		return status.Errorf(codes.InvalidArgument, "first request must be a subscribe request")
+	}
+
+	subscribeReq := models.ToSubscribeRequest(req.GetSubscribe())
+	subscribeReq.Ack = true
+	if err := validateFilters(subscribeReq.Filters); err != nil {
+		return err
+	}
+
+	subscribeReq, err = s.resume(srv.Context(), subscribeReq)
+	if err != nil {
+		return err
+	}
+
+	ch, subscriberID, err := s.broker.Subscribe(srv.Context(), subscribeReq)
+	if err != nil {
+		slog.Error("Failed to subscribe", "subscriber", subscriberID, "error", err.Error())
+		return status.Errorf(codes.Internal, "failed to subscribe: %v", err)
+	}
+
+	// Receive acks and nacks until the client closes its side of the stream
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			req, err := srv.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			if ack := req.GetAck(); ack != nil {
+				s.broker.Ack(subscriberID, ack.Ids)
+			}
+			if nack := req.GetNack(); nack != nil {
+				s.broker.Nack(subscriberID, nack.Ids)
+			}
+		}
+	}()
+
+	for {
+		select {
+		case msg := <-ch:
 			rsp := &pb.MessageResponse{
 				Id:        msg.ID,
 				Timestamp: msg.Timestamp,
 				Topic:     msg.Topic,
+				Key:       msg.Key,
 				Body:      msg.Body,
+				Headers:   msg.Headers,
 			}
 
+			// Messages that used up their delivery attempts are dead-lettered instead
+			if !s.broker.Deliver(srv.Context(), subscriberID, msg) {
+				continue
+			}
 			if err := srv.Send(rsp); err != nil {
 				slog.Error("Failed to send message", "subscriber", subscriberID, "error", err.Error())
-				s.broker.Unsubscribe(subscriberID, req.Topics)
+				s.broker.Unsubscribe(subscriberID)
 				return status.Errorf(codes.Internal, "failed to send message: %v", err)
 			}
 
+		case err := <-recvErr:
+			s.broker.Unsubscribe(subscriberID)
+			if err == io.EOF {
+				return nil
+			}
+			return err
+
 		case <-srv.Context().Done():
-			s.broker.Unsubscribe(subscriberID, req.Topics)
+			s.broker.Unsubscribe(subscriberID)
 			return nil
 		}
 	}
 }
 
-func newAuthFunc(cfg config.Config) auth.AuthFunc {
+func (s *brokerServer) Commit(ctx context.Context, req *pb.CommitRequest) (*pb.CommitResponse, error) {
+	if req.Subscription == "" || req.Topic == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "subscription and topic are required")
+	}
+
+	if err := authorizeSubscribe(ctx, map[string]int64{req.Topic: 0}); err != nil {
+		return nil, err
+	}
+
+	offset := data.Offset{
+		Subscription: subscriptionName(ctx, req.Subscription),
+		Topic:        req.Topic,
+		Timestamp:    req.Timestamp,
+	}
+
+	if err := s.broker.Commit(ctx, offset); err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to commit: %v", err)
+	}
+
+	return &pb.CommitResponse{}, nil
+}
+
+func (s *brokerServer) GetRetention(ctx context.Context, req *pb.GetRetentionRequest) (*pb.GetRetentionResponse, error) {
+	policy := s.retention.GetPolicy(req.Topic)
+
+	return &pb.GetRetentionResponse{
+		Policy: models.RetentionPolicyToPb(policy),
+	}, nil
+}
+
+func (s *brokerServer) SetRetention(ctx context.Context, req *pb.SetRetentionRequest) (*pb.SetRetentionResponse, error) {
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.Policy == nil {
+		return nil, status.Errorf(codes.InvalidArgument, "policy is required")
+	}
+
+	policy := models.ToRetentionPolicy(req.Policy)
+	if policy.MaxAge < 0 || policy.MaxBytes < 0 || policy.MaxMessages < 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "policy limits must not be negative")
+	}
+
+	s.retention.SetPolicy(req.Topic, policy)
+
+	return &pb.SetRetentionResponse{}, nil
+}
+
+func (s *brokerServer) AddNode(ctx context.Context, req *pb.AddNodeRequest) (*pb.AddNodeResponse, error) {
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.Host == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "host is required")
+	}
+
+	if err := s.consensus.AddNode(ctx, req.Host, req.Region); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to add node: %v", err)
+	}
+
+	return &pb.AddNodeResponse{}, nil
+}
+
+func (s *brokerServer) RemoveNode(ctx context.Context, req *pb.RemoveNodeRequest) (*pb.RemoveNodeResponse, error) {
+	if err := authorizeAdmin(ctx); err != nil {
+		return nil, err
+	}
+
+	if req.Host == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "host is required")
+	}
+
+	if err := s.consensus.RemoveNode(ctx, req.Host); err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to remove node: %v", err)
+	}
+
+	return &pb.RemoveNodeResponse{}, nil
+}
+
+func (s *brokerServer) GetNodes(ctx context.Context, req *pb.GetNodesRequest) (*pb.GetNodesResponse, error) {
+	membership, health, err := s.consensus.GetNodes()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to get nodes: %v", err)
+	}
+
+	healthPb := make(map[string]*pb.NodeHealth, len(health))
+	for host, h := range health {
+		healthPb[host] = &pb.NodeHealth{
+			Alive:    h.Alive,
+			Phi:      h.Phi,
+			LastSeen: h.LastSeen.UnixMicro(),
+			Rtt:      h.RTT.Microseconds(),
+		}
+	}
+
+	return &pb.GetNodesResponse{
+		Version:  membership.Version,
+		Nodes:    membership.Nodes,
+		Learners: membership.Learners,
+		Health:   healthPb,
+		Regions:  membership.Regions,
+		Rejected: s.peers.Rejected(),
+	}, nil
+}
+
+func (s *brokerServer) GetTopology(ctx context.Context, req *pb.GetTopologyRequest) (*pb.GetTopologyResponse, error) {
+	endpoints, err := s.consensus.GetTopology()
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to get topology: %v", err)
+	}
+
+	rsp := &pb.GetTopologyResponse{
+		Endpoints: make([]*pb.Endpoint, len(endpoints)),
+	}
+	for i, endpoint := range endpoints {
+		rsp.Endpoints[i] = &pb.Endpoint{
+			Node:    endpoint.Node,
+			Address: endpoint.BrokerAddress,
+			Region:  endpoint.Region,
+			Zone:    endpoint.Zone,
+			Alive:   endpoint.Alive,
+			Rtt:     endpoint.RTT.Microseconds(),
+		}
+	}
+
+	return rsp, nil
+}
+
+func newMessage(req *pb.PublishRequest) (data.Message, error) {
+	if req == nil {
+		return data.Message{}, status.Errorf(codes.InvalidArgument, "message is required")
+	}
+
+	if services.IsWildcard(req.Topic) {
+		return data.Message{}, status.Errorf(codes.InvalidArgument, "topic must not contain wildcards")
+	}
+
+	return data.Message{
+		Topic:          req.Topic,
+		Key:            req.Key,
+		Body:           req.Body,
+		Headers:        req.Headers,
+		IdempotencyKey: req.IdempotencyKey,
+	}, nil
+}
+
+// publishError reports a publish cut short by its deadline or by the client
+// with the matching code, so clients can tell it from a failed consensus.
+func publishError(ctx context.Context, format string, err error) error {
+	if ctx.Err() != nil {
+		return status.Errorf(status.FromContextError(ctx.Err()).Code(), format, err)
+	}
+
+	return status.Errorf(codes.Internal, format, err)
+}
+
+func validateFilters(filters []data.Filter) error {
+	for _, filter := range filters {
+		if err := filter.Validate(); err != nil {
+			return status.Errorf(codes.InvalidArgument, "invalid filter: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// SESSION_HEADER carries the session token issued for a password.
+const SESSION_HEADER = "session-token"
+
+type userKey struct{}
+
+// newBrokerTLSConfig returns the TLS config of the broker server, verifying
+// client certificates if a client CA is configured.
+func newBrokerTLSConfig(cfg config.Config) (*tls.Config, error) {
+	var clientAuth tls.ClientAuthType
+	switch cfg.BrokerClientAuth {
+	case "optional":
+		clientAuth = tls.VerifyClientCertIfGiven
+	case "require":
+		clientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown client auth %s", cfg.BrokerClientAuth)
+	}
+
+	// Without a CA client certificates are never requested, so none would be required
+	if clientAuth == tls.RequireAndVerifyClientCert && cfg.BrokerClientCA == "" {
+		return nil, errors.New("BROKER_CLIENT_AUTH=require needs BROKER_CLIENT_CA")
+	}
+
+	certs, err := services.NewBrokerCertificates(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	return certs.ServerConfig(clientAuth), nil
+}
+
+// newAuthFunc authenticates clients with a "basic" username and password,
+// a "session" token issued for a password, a "bearer" token signed by an
+// identity provider or, without credentials, the verified client certificate
+// of the connection.
+func newAuthFunc(authService services.AuthService) auth.AuthFunc {
 	return func(ctx context.Context) (context.Context, error) {
+		if cert := clientCertificate(ctx); cert != nil && !hasAuthorization(ctx) {
+			user, err := authService.AuthenticateCertificate(cert)
+			if err != nil {
+				return nil, status.Errorf(codes.Unauthenticated, "invalid client certificate: %v", err)
+			}
+
+			return context.WithValue(ctx, userKey{}, user), nil
+		}
+
+		if token, err := auth.AuthFromMD(ctx, "session"); err == nil {
+			user, err := authService.AuthenticateSession(token)
+			if err != nil {
+				return nil, status.Errorf(codes.Unauthenticated, "invalid auth token: %v", err)
+			}
+
+			return context.WithValue(ctx, userKey{}, user), nil
+		}
+
+		if token, err := auth.AuthFromMD(ctx, "bearer"); err == nil {
+			user, err := authService.AuthenticateToken(token)
+			if err != nil {
+				return nil, status.Errorf(codes.Unauthenticated, "invalid auth token: %v", err)
+			}
+
+			return context.WithValue(ctx, userKey{}, user), nil
+		}
+
 		token, err := auth.AuthFromMD(ctx, "basic")
 		if err != nil {
 			return nil, err
 		}
 
-		auth := cfg.Username + ":" + cfg.Password
-		authEncoded := base64.StdEncoding.EncodeToString([]byte(auth))
-		if token != authEncoded {
+		credentials, err := base64.StdEncoding.DecodeString(token)
+		if err != nil {
+			return nil, status.Errorf(codes.Unauthenticated, "invalid auth token: %v", err)
+		}
+
+		username, password, _ := strings.Cut(string(credentials), ":")
+		user, err := authService.Authenticate(username, password)
+		if err != nil {
 			return nil, status.Errorf(codes.Unauthenticated, "invalid auth token: %v", err)
 		}
 
-		return ctx, nil
+		// Hashing the password is slow, so later requests can use a session token
+		session, err := authService.NewSession(user)
+		if err != nil {
+			slog.Error("Failed to create session", "user", user.Name, "error", err.Error())
+		} else if session != "" {
+			if err := grpc.SetHeader(ctx, metadata.Pairs(SESSION_HEADER, session)); err != nil {
+				slog.Error("Failed to send session token", "user", user.Name, "error", err.Error())
+			}
+		}
+
+		return context.WithValue(ctx, userKey{}, user), nil
 	}
 }
+
+// clientCertificate returns the verified client certificate of the connection, if any.
+func clientCertificate(ctx context.Context) *x509.Certificate {
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return nil
+	}
+
+	tlsInfo, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(tlsInfo.State.VerifiedChains) == 0 || len(tlsInfo.State.VerifiedChains[0]) == 0 {
+		return nil
+	}
+
+	return tlsInfo.State.VerifiedChains[0][0]
+}
+
+func hasAuthorization(ctx context.Context) bool {
+	return len(metadata.ValueFromIncomingContext(ctx, "authorization")) > 0
+}
+
+func userFromContext(ctx context.Context) services.User {
+	user, _ := ctx.Value(userKey{}).(services.User)
+	return user
+}
+
+func authorizePublish(ctx context.Context, topic string) error {
+	user := userFromContext(ctx)
+	if !user.CanPublish(topic) {
+		return status.Errorf(codes.PermissionDenied, "user %s may not publish to topic %s", user.Name, topic)
+	}
+
+	return nil
+}
+
+func authorizeSubscribe(ctx context.Context, topics map[string]int64) error {
+	user := userFromContext(ctx)
+	for topic := range topics {
+		if !user.CanSubscribe(topic) {
+			return status.Errorf(codes.PermissionDenied, "user %s may not subscribe to topic %s", user.Name, topic)
+		}
+	}
+
+	return nil
+}
+
+// resume adds the committed positions of a durable subscription to the request
+// and checks that the user may subscribe to all of its topics, including the
+// committed ones, before anything is replayed.
+func (s *brokerServer) resume(ctx context.Context, req models.SubscribeRequest) (models.SubscribeRequest, error) {
+	if req.Subscription != "" {
+		req.Subscription = subscriptionName(ctx, req.Subscription)
+	}
+
+	req, err := s.broker.Resume(ctx, req)
+	if err != nil {
+		slog.Error("Failed to resume subscription", "subscription", req.Subscription, "error", err.Error())
+		return req, status.Errorf(codes.Internal, "failed to resume subscription: %v", err)
+	}
+
+	if err := authorizeSubscribe(ctx, req.Topics); err != nil {
+		return req, err
+	}
+
+	return req, nil
+}
+
+// subscriptionName returns the name a durable subscription is stored under,
+// prefixed with its user, so users can not read or move each other's positions.
+func subscriptionName(ctx context.Context, name string) string {
+	return url.PathEscape(userFromContext(ctx).Name) + "/" + name
+}
+
+func authorizeAdmin(ctx context.Context) error {
+	user := userFromContext(ctx)
+	if !user.Admin {
+		return status.Errorf(codes.PermissionDenied, "user %s is not an admin", user.Name)
+	}
+
+	return nil
+}
@@ -3,15 +3,12 @@ package api
 import (
 	"context"
 	"crypto/tls"
-	"crypto/x509"
-	"errors"
 	"geo-distributed-message-broker/config"
 	"geo-distributed-message-broker/models"
 	"geo-distributed-message-broker/pb"
 	"geo-distributed-message-broker/services"
 	"log/slog"
 	"net"
-	"os"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/codes"
@@ -19,39 +16,20 @@ import (
 	"google.golang.org/grpc/status"
 )
 
-func NewNodeServer(cfg config.Config, consensus services.ConsensusService) (*grpc.Server, net.Listener, error) {
+func NewNodeServer(cfg config.Config, consensus services.ConsensusService, certs *services.Certificates, peers *services.PeerVerifier) (*grpc.Server, net.Listener, error) {
 	slog.Info("Creating new node server 🌐")
 
-	// read ca's cert, verify to client's certificate
-	caPem, err := os.ReadFile("cert/ca-cert.pem")
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// create cert pool and append ca's cert
-	certPool := x509.NewCertPool()
-	if !certPool.AppendCertsFromPEM(caPem) {
-		return nil, nil, errors.New("failed to append ca's cert")
-	}
-
-	// read server cert & key
-	serverCert, err := tls.LoadX509KeyPair("cert/server-cert.pem", "cert/server-key.pem")
-	if err != nil {
-		return nil, nil, err
-	}
-
-	// configuration of the certificate what we want to
-	conf := &tls.Config{
-		Certificates: []tls.Certificate{serverCert},
-		ClientAuth:   tls.RequireAndVerifyClientCert,
-		ClientCAs:    certPool,
-	}
-
-	// create tls credentials
-	tlsCredentials := credentials.NewTLS(conf)
+	// Client certificates of other nodes are verified against the CA
+	tlsCredentials := credentials.NewTLS(certs.ServerConfig(tls.RequireAndVerifyClientCert))
 
 	srv := &nodeServer{
 		consensus: consensus,
+		peers:     peers,
+		info: models.NodeInfo{
+			BrokerAddress: cfg.BrokerAddress,
+			Region:        cfg.Region,
+			Zone:          cfg.Zone,
+		},
 	}
 
 	listener, err := net.Listen("tcp", cfg.NodePort)
@@ -59,7 +37,10 @@ func NewNodeServer(cfg config.Config, consensus services.ConsensusService) (*grp
 		return nil, nil, err
 	}
 
-	grpcSrv := grpc.NewServer(grpc.Creds(tlsCredentials))
+	grpcSrv := grpc.NewServer(
+		grpc.Creds(tlsCredentials),
+		grpc.UnaryInterceptor(srv.verifyPeer),
+	)
 
 	pb.RegisterNodeServer(grpcSrv, srv)
 
@@ -69,10 +50,27 @@ func NewNodeServer(cfg config.Config, consensus services.ConsensusService) (*grp
 type nodeServer struct {
 	pb.UnsafeNodeServer
 	consensus services.ConsensusService
+	info      models.NodeInfo // reported in heartbeats
+	peers     *services.PeerVerifier
+}
+
+// verifyPeer rejects requests from holders of a valid certificate that are
+// not members of the cluster, so they can not vote or inject stable messages.
+func (s *nodeServer) verifyPeer(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+	cert := clientCertificate(ctx)
+	if cert == nil {
+		return nil, status.Errorf(codes.Unauthenticated, "client certificate is required")
+	}
+
+	if err := s.peers.Verify(cert, info.FullMethod); err != nil {
+		return nil, status.Errorf(codes.PermissionDenied, "%v", err)
+	}
+
+	return handler(ctx, req)
 }
 
 func (s *nodeServer) Propose(ctx context.Context, req *pb.ProposeRequest) (*pb.ProposeResponse, error) {
-	rsp, err := s.consensus.Propose(models.ToProposeRequest(req))
+	rsp, err := s.consensus.Propose(ctx, models.ToProposeRequest(req))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to propose: %v", err)
 	}
@@ -81,7 +79,7 @@ func (s *nodeServer) Propose(ctx context.Context, req *pb.ProposeRequest) (*pb.P
 }
 
 func (s *nodeServer) Stable(ctx context.Context, req *pb.StableRequest) (*pb.StableResponse, error) {
-	err := s.consensus.Stable(models.ToStableRequest(req))
+	err := s.consensus.Stable(ctx, models.ToStableRequest(req))
 	if err != nil {
 		return nil, status.Errorf(codes.Internal, "failed to stable: %v", err)
 	}
@@ -90,3 +88,92 @@ func (s *nodeServer) Stable(ctx context.Context, req *pb.StableRequest) (*pb.Sta
 		Ack: true,
 	}, nil
 }
+
+func (s *nodeServer) ProposeBatch(ctx context.Context, req *pb.ProposeBatchRequest) (*pb.ProposeBatchResponse, error) {
+	rsp, err := s.consensus.ProposeBatch(ctx, models.ToProposeBatchRequest(req))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to propose batch: %v", err)
+	}
+
+	return rsp.ToPb(), nil
+}
+
+func (s *nodeServer) StableBatch(ctx context.Context, req *pb.StableBatchRequest) (*pb.StableResponse, error) {
+	err := s.consensus.StableBatch(ctx, models.ToStableBatchRequest(req))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to stable batch: %v", err)
+	}
+
+	return &pb.StableResponse{
+		Ack: true,
+	}, nil
+}
+
+func (s *nodeServer) Abort(ctx context.Context, req *pb.AbortRequest) (*pb.AbortResponse, error) {
+	err := s.consensus.Abort(ctx, models.ToAbortRequest(req))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to abort: %v", err)
+	}
+
+	return &pb.AbortResponse{}, nil
+}
+
+func (s *nodeServer) Forward(ctx context.Context, req *pb.ForwardRequest) (*pb.ForwardResponse, error) {
+	forwardReq := models.ToForwardRequest(req)
+
+	ids, err := s.consensus.PublishBatch(ctx, forwardReq.Messages)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to publish forwarded messages: %v", err)
+	}
+
+	return models.ForwardResponse{IDs: ids}.ToPb(), nil
+}
+
+func (s *nodeServer) Digest(ctx context.Context, req *pb.DigestRequest) (*pb.DigestResponse, error) {
+	rsp, err := s.consensus.Digest(ctx, models.ToDigestRequest(req))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to digest: %v", err)
+	}
+
+	return rsp.ToPb(), nil
+}
+
+func (s *nodeServer) Pull(ctx context.Context, req *pb.PullRequest) (*pb.PullResponse, error) {
+	rsp, err := s.consensus.Pull(ctx, models.ToPullRequest(req))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to pull: %v", err)
+	}
+
+	return rsp.ToPb(), nil
+}
+
+func (s *nodeServer) Join(ctx context.Context, req *pb.MembershipRequest) (*pb.MembershipResponse, error) {
+	err := s.consensus.Join(ctx, models.ToMembership(req))
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "failed to join: %v", err)
+	}
+
+	return &pb.MembershipResponse{}, nil
+}
+
+func (s *nodeServer) ProposeMembership(ctx context.Context, req *pb.MembershipRequest) (*pb.MembershipResponse, error) {
+	err := s.consensus.ProposeMembership(ctx, models.ToMembership(req))
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to agree to membership: %v", err)
+	}
+
+	return &pb.MembershipResponse{}, nil
+}
+
+func (s *nodeServer) UpdateMembership(ctx context.Context, req *pb.MembershipRequest) (*pb.MembershipResponse, error) {
+	err := s.consensus.UpdateMembership(ctx, models.ToMembership(req))
+	if err != nil {
+		return nil, status.Errorf(codes.FailedPrecondition, "failed to update membership: %v", err)
+	}
+
+	return &pb.MembershipResponse{}, nil
+}
+
+func (s *nodeServer) Heartbeat(ctx context.Context, req *pb.HeartbeatRequest) (*pb.HeartbeatResponse, error) {
+	return s.info.ToPb(), nil
+}
@@ -1,6 +1,12 @@
 package config
 
 import (
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
 	"github.com/caarlos0/env"
 )
 
@@ -11,13 +17,137 @@ type Config struct {
 	Nodes      []string `env:"NODES" envSeparator:" " envDefault:""`
 	Username   string   `env:"USERNAME" envDefault:"admin"`
 	Password   string   `env:"PASSWORD" envDefault:"password"`
+	UsersFile  string   `env:"USERS_FILE" envDefault:""` // users with hashed passwords and topic grants, replaces USERNAME and PASSWORD
+
+	SessionTTL    time.Duration `env:"SESSION_TTL" envDefault:"15m"`            // lifetime of session tokens issued for passwords, 0 disables them
+	JWTKeys       []string      `env:"JWT_KEYS" envSeparator:" " envDefault:""` // PEM public keys or certificates verifying bearer tokens
+	JWKSFile      string        `env:"JWKS_FILE" envDefault:""`                 // JSON Web Key Set verifying bearer tokens
+	JWTIssuer     string        `env:"JWT_ISSUER" envDefault:""`                // empty accepts every issuer
+	JWTAudience   string        `env:"JWT_AUDIENCE" envDefault:""`              // required with JWT_KEYS or JWKS_FILE
+	JWTScopeClaim string        `env:"JWT_SCOPE_CLAIM" envDefault:"scope"`      // claim with "publish:<topic>", "subscribe:<topic>" and "admin" scopes
+	JWTLeeway     time.Duration `env:"JWT_LEEWAY" envDefault:"30s"`             // allowed clock skew for expiry
+
+	CACert             string        `env:"CA_CERT" envDefault:"cert/ca-cert.pem"` // CA of the node certificates
+	ServerCert         string        `env:"SERVER_CERT" envDefault:"cert/server-cert.pem"`
+	ServerKey          string        `env:"SERVER_KEY" envDefault:"cert/server-key.pem"`
+	ClientCert         string        `env:"CLIENT_CERT" envDefault:"cert/client-cert.pem"`
+	ClientKey          string        `env:"CLIENT_KEY" envDefault:"cert/client-key.pem"`
+	CertReloadInterval time.Duration `env:"CERT_RELOAD_INTERVAL" envDefault:"10s"` // how often certificate files are checked for changes, 0 disables reloading
+
+	BrokerTLS        bool   `env:"BROKER_TLS" envDefault:"false"`
+	BrokerCert       string `env:"BROKER_CERT" envDefault:"cert/server-cert.pem"`
+	BrokerKey        string `env:"BROKER_KEY" envDefault:"cert/server-key.pem"`
+	BrokerClientCA   string `env:"BROKER_CLIENT_CA" envDefault:""`           // CA of client certificates, empty disables them
+	BrokerClientAuth string `env:"BROKER_CLIENT_AUTH" envDefault:"optional"` // "optional" or "require" a client certificate
+
+	NodeAddress    string   `env:"NODE_ADDRESS" envDefault:"localhost:8071"`     // address other nodes reach this node at
+	MembershipFile string   `env:"MEMBERSHIP_FILE" envDefault:"membership.json"` // overrides NODES once the membership changed
+	SeedNodes      []string `env:"SEED_NODES" envSeparator:" " envDefault:""`    // members allowed to add this node to a cluster while it has no other members
+	BrokerAddress  string   `env:"BROKER_ADDRESS" envDefault:"localhost:8070"`   // address clients reach this node at
+
+	Region       string            `env:"REGION" envDefault:""`
+	Zone         string            `env:"ZONE" envDefault:""`
+	NodeRegions  map[string]string `env:"NODE_REGIONS" envDefault:""`          // "host:region host:region", regions of the nodes in NODES
+	QuorumPolicy string            `env:"QUORUM_POLICY" envDefault:"majority"` // "majority", "regions" or "local"
+
+	HeartbeatInterval time.Duration `env:"HEARTBEAT_INTERVAL" envDefault:"1s"` // 0 disables failure detection
+	PhiThreshold      float64       `env:"PHI_THRESHOLD" envDefault:"8"`       // phi above which a node is suspected to be down
+
+	PublishTimeout time.Duration `env:"PUBLISH_TIMEOUT" envDefault:"30s"` // bound on a publish of a client, including retries
+	ProposeTimeout time.Duration `env:"PROPOSE_TIMEOUT" envDefault:"5s"`  // bound on a propose request to another node
+	StableTimeout  time.Duration `env:"STABLE_TIMEOUT" envDefault:"15s"`  // bound on a stable request to another node
+	NodeTimeout    time.Duration `env:"NODE_TIMEOUT" envDefault:"30s"`    // bound on forward, sync and membership requests
+
+	MaxInflightPublishes int           `env:"MAX_INFLIGHT_PUBLISHES" envDefault:"64"`
+	DeduplicationWindow  time.Duration `env:"DEDUPLICATION_WINDOW" envDefault:"5m"`
+	PipelineDepth        int           `env:"PIPELINE_DEPTH" envDefault:"4"`
+	PipelineMaxBatch     int           `env:"PIPELINE_MAX_BATCH" envDefault:"100"`
+	ConsensusLog         string        `env:"CONSENSUS_LOG" envDefault:"consensus.wal"` // empty disables crash recovery
+	SyncInterval         time.Duration `env:"SYNC_INTERVAL" envDefault:"1m"`            // 0 disables anti-entropy sync
+	SyncWindow           time.Duration `env:"SYNC_WINDOW" envDefault:"1h"`              // how far back messages are compared
+
+	ConsensusEngine string   `env:"CONSENSUS_ENGINE" envDefault:"timestamp"` // "timestamp" or "raft"
+	RaftPort        string   `env:"RAFT_PORT" envDefault:":8072"`
+	RaftAddress     string   `env:"RAFT_ADDRESS" envDefault:"localhost:8072"`  // address of this node's raft transport, also its raft ID
+	RaftNodes       []string `env:"RAFT_NODES" envSeparator:" " envDefault:""` // raft addresses of the other nodes, in the order of NODES
+	RaftDir         string   `env:"RAFT_DIR" envDefault:"raft"`
+
+	VisibilityTimeout        time.Duration  `env:"VISIBILITY_TIMEOUT" envDefault:"30s"`
+	MaxDeliveryAttempts      int            `env:"MAX_DELIVERY_ATTEMPTS" envDefault:"5"`
+	TopicMaxDeliveryAttempts map[string]int `env:"TOPIC_MAX_DELIVERY_ATTEMPTS" envDefault:""` // "topic:attempts topic:attempts"
+
+	RetentionInterval         time.Duration            `env:"RETENTION_INTERVAL" envDefault:"1m"`
+	RetentionMaxAge           time.Duration            `env:"RETENTION_MAX_AGE" envDefault:"0"`
+	RetentionMaxBytes         int                      `env:"RETENTION_MAX_BYTES" envDefault:"0"`
+	RetentionMaxMessages      int                      `env:"RETENTION_MAX_MESSAGES" envDefault:"0"`
+	TopicRetentionMaxAge      map[string]time.Duration `env:"TOPIC_RETENTION_MAX_AGE" envDefault:""`      // "topic:duration topic:duration"
+	TopicRetentionMaxBytes    map[string]int           `env:"TOPIC_RETENTION_MAX_BYTES" envDefault:""`    // "topic:bytes topic:bytes"
+	TopicRetentionMaxMessages map[string]int           `env:"TOPIC_RETENTION_MAX_MESSAGES" envDefault:""` // "topic:count topic:count"
+
+	CompactedTopics []string `env:"COMPACTED_TOPICS" envSeparator:" " envDefault:""`
 }
 
 func NewConfig() (Config, error) {
 	var cfg Config
-	if err := env.Parse(&cfg); err != nil {
+	if err := env.ParseWithFuncs(&cfg, env.CustomParsers{
+		reflect.TypeOf(map[string]int{}):           parseTopicInts,
+		reflect.TypeOf(map[string]time.Duration{}): parseTopicDurations,
+		reflect.TypeOf(map[string]string{}):        parseStrings,
+	}); err != nil {
 		return cfg, err
 	}
 
+	// Publish streams wait for a free slot, so without slots they never publish
+	if cfg.MaxInflightPublishes < 1 {
+		return cfg, fmt.Errorf("MAX_INFLIGHT_PUBLISHES must be at least 1, got %d", cfg.MaxInflightPublishes)
+	}
+
+	// Rounds are batched into a buffer of PIPELINE_MAX_BATCH messages
+	if cfg.PipelineDepth < 0 {
+		return cfg, fmt.Errorf("PIPELINE_DEPTH must not be negative, got %d", cfg.PipelineDepth)
+	}
+	if cfg.PipelineMaxBatch < 1 {
+		return cfg, fmt.Errorf("PIPELINE_MAX_BATCH must be at least 1, got %d", cfg.PipelineMaxBatch)
+	}
+
+	// The retention job is rescheduled after every run, so it must wait in between
+	if cfg.RetentionInterval <= 0 {
+		return cfg, fmt.Errorf("RETENTION_INTERVAL must be positive, got %s", cfg.RetentionInterval)
+	}
+
 	return cfg, nil
 }
+
+// parseTopicInts parses space separated "topic:value" pairs.
+func parseTopicInts(v string) (interface{}, error) {
+	return parseTopicValues(v, strconv.Atoi)
+}
+
+// parseTopicDurations parses space separated "topic:duration" pairs.
+func parseTopicDurations(v string) (interface{}, error) {
+	return parseTopicValues(v, time.ParseDuration)
+}
+
+// parseStrings parses space separated "key:value" pairs, keys may be "host:port".
+func parseStrings(v string) (interface{}, error) {
+	return parseTopicValues(v, func(s string) (string, error) { return s, nil })
+}
+
+func parseTopicValues[T any](v string, parse func(string) (T, error)) (map[string]T, error) {
+	values := map[string]T{}
+	for _, pair := range strings.Fields(v) {
+		// Split on the last colon, topic names may contain colons
+		i := strings.LastIndex(pair, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("invalid topic value %q", pair)
+		}
+
+		value, err := parse(pair[i+1:])
+		if err != nil {
+			return nil, fmt.Errorf("invalid topic value %q: %v", pair, err)
+		}
+		values[pair[:i]] = value
+	}
+
+	return values, nil
+}
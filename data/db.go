@@ -19,7 +19,15 @@ func NewDB(cfg config.Config) (*gorm.DB, error) {
 		return nil, err
 	}
 
-	db.AutoMigrate(&Message{})
+	// Readers see a consistent state without blocking writers, e.g. raft snapshots
+	if err := db.Exec("PRAGMA journal_mode=WAL").Error; err != nil {
+		return nil, err
+	}
+
+	// Creates missing tables and indexes of databases written by older versions
+	if err := db.AutoMigrate(&Message{}, &Offset{}, &Delivery{}); err != nil {
+		return nil, err
+	}
 
 	return db, nil
 }
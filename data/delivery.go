@@ -0,0 +1,9 @@
+package data
+
+// Delivery counts the attempts to deliver a message to a consumer, a group
+// or a durable subscription, across its connections.
+type Delivery struct {
+	Consumer  string `json:"consumer" gorm:"primaryKey"`
+	MessageID string `json:"message_id" gorm:"primaryKey"`
+	Attempts  int    `json:"attempts"`
+}
@@ -0,0 +1,163 @@
+package data
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+const (
+	FilterEquals = "equals"
+	FilterPrefix = "prefix"
+)
+
+// Filter matches a message field against a value. The field is "key",
+// "body", "headers.<name>" or "body.<path>" for a dot separated JSON path
+// into the body, e.g. "body.customer.id" or "body.items.0.sku".
+type Filter struct {
+	Field    string
+	Operator string
+	Value    string
+}
+
+func (f Filter) Validate() error {
+	if f.Operator != FilterEquals && f.Operator != FilterPrefix {
+		return fmt.Errorf("invalid filter operator %q", f.Operator)
+	}
+
+	switch {
+	case f.Field == "key", f.Field == "body":
+	case strings.HasPrefix(f.Field, "headers.") && len(f.Field) > len("headers."):
+	case strings.HasPrefix(f.Field, "body.") && len(f.Field) > len("body."):
+	default:
+		return fmt.Errorf("invalid filter field %q", f.Field)
+	}
+
+	return nil
+}
+
+// Match reports whether the message matches all filters.
+func Match(filters []Filter, msg Message) bool {
+	for _, f := range filters {
+		if !f.Match(msg) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (f Filter) Match(msg Message) bool {
+	value, ok := f.value(msg)
+	if !ok {
+		return false
+	}
+
+	if f.Operator == FilterPrefix {
+		return strings.HasPrefix(value, f.Value)
+	}
+
+	return value == f.Value
+}
+
+func (f Filter) value(msg Message) (string, bool) {
+	switch {
+	case f.Field == "key":
+		return msg.Key, true
+
+	case f.Field == "body":
+		return string(msg.Body), true
+
+	case strings.HasPrefix(f.Field, "headers."):
+		value, ok := msg.Headers[strings.TrimPrefix(f.Field, "headers.")]
+		return value, ok
+
+	case strings.HasPrefix(f.Field, "body."):
+		decoder := json.NewDecoder(bytes.NewReader(msg.Body))
+		decoder.UseNumber()
+
+		var node interface{}
+		if err := decoder.Decode(&node); err != nil {
+			return "", false
+		}
+
+		for _, segment := range strings.Split(strings.TrimPrefix(f.Field, "body."), ".") {
+			switch n := node.(type) {
+			case map[string]interface{}:
+				node = n[segment]
+			case []interface{}:
+				i, err := strconv.Atoi(segment)
+				if err != nil || i < 0 || i >= len(n) {
+					return "", false
+				}
+				node = n[i]
+			default:
+				return "", false
+			}
+		}
+
+		switch n := node.(type) {
+		case nil:
+			return "", false
+		case string:
+			return n, true
+		case json.Number:
+			return n.String(), true
+		case bool:
+			return strconv.FormatBool(n), true
+		default:
+			value, err := json.Marshal(n)
+			return string(value), err == nil
+		}
+	}
+
+	return "", false
+}
+
+// sql returns a condition that keeps at least every row the filter matches,
+// values SQLite can not compare exactly are left to Match.
+func (f Filter) sql() (string, []interface{}) {
+	compare := func(expr string) string {
+		if f.Operator == FilterPrefix {
+			return "instr(" + expr + ", ?) = 1"
+		}
+		return expr + " = ?"
+	}
+
+	switch {
+	case f.Field == "key":
+		return compare("key"), []interface{}{f.Value}
+
+	case f.Field == "body":
+		return compare("CAST(body AS TEXT)"), []interface{}{f.Value}
+
+	case strings.HasPrefix(f.Field, "headers."):
+		path := jsonPath([]string{strings.TrimPrefix(f.Field, "headers.")})
+		return compare("json_extract(headers, ?)"), []interface{}{path, f.Value}
+
+	case strings.HasPrefix(f.Field, "body."):
+		path := jsonPath(strings.Split(strings.TrimPrefix(f.Field, "body."), "."))
+		query := "CASE WHEN json_valid(CAST(body AS TEXT)) THEN CASE json_type(CAST(body AS TEXT), ?)" +
+			" WHEN 'text' THEN " + compare("json_extract(CAST(body AS TEXT), ?)") +
+			" WHEN 'integer' THEN " + compare("CAST(json_extract(CAST(body AS TEXT), ?) AS TEXT)") +
+			" ELSE 1 END ELSE 0 END"
+		return query, []interface{}{path, path, f.Value, path, f.Value}
+	}
+
+	return "1", nil
+}
+
+func jsonPath(segments []string) string {
+	path := "$"
+	for _, segment := range segments {
+		if _, err := strconv.Atoi(segment); err == nil {
+			path += "[" + segment + "]"
+			continue
+		}
+		path += "." + strconv.Quote(segment)
+	}
+
+	return path
+}
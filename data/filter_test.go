@@ -0,0 +1,135 @@
+package data
+
+import (
+	"context"
+	"geo-distributed-message-broker/config"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestFilterValidate(t *testing.T) {
+	tests := []struct {
+		name    string
+		filter  Filter
+		wantErr bool
+	}{
+		{name: "key equals", filter: Filter{Field: "key", Operator: FilterEquals, Value: "k1"}},
+		{name: "body prefix", filter: Filter{Field: "body", Operator: FilterPrefix, Value: "{"}},
+		{name: "header", filter: Filter{Field: "headers.trace_id", Operator: FilterEquals, Value: "abc"}},
+		{name: "body path", filter: Filter{Field: "body.customer.id", Operator: FilterEquals, Value: "42"}},
+		{name: "unknown operator", filter: Filter{Field: "key", Operator: "contains", Value: "k"}, wantErr: true},
+		{name: "missing operator", filter: Filter{Field: "key", Value: "k"}, wantErr: true},
+		{name: "unknown field", filter: Filter{Field: "topic", Operator: FilterEquals, Value: "orders"}, wantErr: true},
+		{name: "header without name", filter: Filter{Field: "headers.", Operator: FilterEquals, Value: "abc"}, wantErr: true},
+		{name: "body path without segments", filter: Filter{Field: "body.", Operator: FilterEquals, Value: "42"}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.filter.Validate(); (err != nil) != tt.wantErr {
+				t.Fatalf("Validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+var filterTests = []struct {
+	name   string
+	filter Filter
+	msg    Message
+	want   bool
+}{
+	{name: "key equals", filter: Filter{Field: "key", Operator: FilterEquals, Value: "k1"}, msg: Message{Key: "k1"}, want: true},
+	{name: "key differs", filter: Filter{Field: "key", Operator: FilterEquals, Value: "k1"}, msg: Message{Key: "k2"}},
+	{name: "key prefix", filter: Filter{Field: "key", Operator: FilterPrefix, Value: "eu."}, msg: Message{Key: "eu.de"}, want: true},
+	{name: "body equals", filter: Filter{Field: "body", Operator: FilterEquals, Value: "hello"}, msg: Message{Body: []byte("hello")}, want: true},
+	{name: "header equals", filter: Filter{Field: "headers.region", Operator: FilterEquals, Value: "eu"}, msg: Message{Headers: map[string]string{"region": "eu"}}, want: true},
+	{name: "header prefix", filter: Filter{Field: "headers.region", Operator: FilterPrefix, Value: "e"}, msg: Message{Headers: map[string]string{"region": "eu"}}, want: true},
+	{name: "header missing", filter: Filter{Field: "headers.region", Operator: FilterEquals, Value: ""}, msg: Message{Headers: map[string]string{"zone": "a"}}},
+	{name: "header empty", filter: Filter{Field: "headers.region", Operator: FilterEquals, Value: ""}, msg: Message{Headers: map[string]string{"region": ""}}, want: true},
+	{name: "body string", filter: Filter{Field: "body.customer.name", Operator: FilterEquals, Value: "ada"}, msg: Message{Body: []byte(`{"customer":{"name":"ada"}}`)}, want: true},
+	{name: "body number", filter: Filter{Field: "body.customer.id", Operator: FilterEquals, Value: "42"}, msg: Message{Body: []byte(`{"customer":{"id":42}}`)}, want: true},
+	{name: "body large number", filter: Filter{Field: "body.id", Operator: FilterEquals, Value: "9007199254740993"}, msg: Message{Body: []byte(`{"id":9007199254740993}`)}, want: true},
+	{name: "body bool", filter: Filter{Field: "body.paid", Operator: FilterEquals, Value: "true"}, msg: Message{Body: []byte(`{"paid":true}`)}, want: true},
+	{name: "body array index", filter: Filter{Field: "body.items.1.sku", Operator: FilterEquals, Value: "b"}, msg: Message{Body: []byte(`{"items":[{"sku":"a"},{"sku":"b"}]}`)}, want: true},
+	{name: "body array out of range", filter: Filter{Field: "body.items.2.sku", Operator: FilterEquals, Value: "b"}, msg: Message{Body: []byte(`{"items":[{"sku":"a"},{"sku":"b"}]}`)}},
+	{name: "body path missing", filter: Filter{Field: "body.customer.id", Operator: FilterEquals, Value: "42"}, msg: Message{Body: []byte(`{"customer":{}}`)}},
+	{name: "body null", filter: Filter{Field: "body.customer", Operator: FilterEquals, Value: "null"}, msg: Message{Body: []byte(`{"customer":null}`)}},
+	{name: "body not json", filter: Filter{Field: "body.customer.id", Operator: FilterEquals, Value: "42"}, msg: Message{Body: []byte("not json")}},
+	{name: "body path prefix", filter: Filter{Field: "body.sku", Operator: FilterPrefix, Value: "ab"}, msg: Message{Body: []byte(`{"sku":"abc"}`)}, want: true},
+}
+
+func TestFilterMatch(t *testing.T) {
+	for _, tt := range filterTests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.filter.Match(tt.msg); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMatchAllFilters(t *testing.T) {
+	msg := Message{Key: "k1", Headers: map[string]string{"region": "eu"}}
+	key := Filter{Field: "key", Operator: FilterEquals, Value: "k1"}
+	region := Filter{Field: "headers.region", Operator: FilterEquals, Value: "eu"}
+	other := Filter{Field: "headers.region", Operator: FilterEquals, Value: "us"}
+
+	tests := []struct {
+		name    string
+		filters []Filter
+		want    bool
+	}{
+		{name: "no filters", want: true},
+		{name: "all match", filters: []Filter{key, region}, want: true},
+		{name: "one differs", filters: []Filter{key, other}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := Match(tt.filters, msg); got != tt.want {
+				t.Errorf("Match() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// Filters are also applied by the database when replaying, which must not drop matching messages.
+func TestFilterReplay(t *testing.T) {
+	db, err := NewDB(config.Config{Database: filepath.Join(t.TempDir(), "filter.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer CloseDB(db)
+	repo := NewRepository(db)
+
+	for i, tt := range filterTests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := tt.msg
+			msg.ID = tt.name
+			msg.Topic = "filter-" + tt.name
+			msg.Timestamp = int64(i + 1)
+			if err := repo.CreateMessage(context.Background(), &msg); err != nil {
+				t.Fatal(err)
+			}
+
+			var replayed []string
+			for msgs := range repo.GetMessages(context.Background(), msg.Topic, 0, tt.filter) {
+				for _, m := range msgs {
+					if tt.filter.Match(m) {
+						replayed = append(replayed, m.ID)
+					}
+				}
+			}
+
+			var want []string
+			if tt.want {
+				want = []string{msg.ID}
+			}
+			if !reflect.DeepEqual(replayed, want) {
+				t.Errorf("replayed = %v, want %v", replayed, want)
+			}
+		})
+	}
+}
@@ -1,8 +1,11 @@
 package data
 
 type Message struct {
-	ID        string `json:"id" gorm:"primaryKey"`
-	Timestamp int64  `json:"timestamp"`
-	Topic     string `json:"topic"`
-	Body      []byte `json:"body"`
+	ID             string            `json:"id" gorm:"primaryKey"`
+	Timestamp      int64             `json:"timestamp" gorm:"index:idx_messages_topic_timestamp,priority:2"`
+	Topic          string            `json:"topic" gorm:"index:idx_messages_topic_key,priority:1;index:idx_messages_topic_timestamp,priority:1"`
+	Key            string            `json:"key" gorm:"index:idx_messages_topic_key,priority:2"`
+	Body           []byte            `json:"body"`
+	Headers        map[string]string `json:"headers" gorm:"serializer:json"`
+	IdempotencyKey string            `json:"idempotency_key" gorm:"index"`
 }
@@ -0,0 +1,7 @@
+package data
+
+type Offset struct {
+	Subscription string `json:"subscription" gorm:"primaryKey"`
+	Topic        string `json:"topic" gorm:"primaryKey"`
+	Timestamp    int64  `json:"timestamp"`
+}
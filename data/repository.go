@@ -1,16 +1,41 @@
 package data
 
 import (
+	"context"
 	"errors"
 	"log/slog"
 	"time"
 
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 type Repository interface {
-	CreateMessage(message *Message) error
-	GetMessages(topicName string, timestamp int64) <-chan []Message
+	CreateMessage(ctx context.Context, message *Message) error
+	CreateMessages(ctx context.Context, messages []Message) error
+	GetMessages(ctx context.Context, topicName string, timestamp int64, filters ...Filter) <-chan []Message
+	CommitOffset(ctx context.Context, offset *Offset) error
+	GetOffsets(ctx context.Context, subscription string) (map[string]int64, error)
+	GetTopics() ([]string, error)
+	DeleteMessages(topicName string, policy RetentionPolicy) (int64, error)
+	GetRetentionHorizon(topicName string, policy RetentionPolicy) (int64, error)
+	CompactMessages(ctx context.Context, topicName string, key string) (int64, error)
+	GetMessageID(idempotencyKey string, timestamp int64) (string, error)
+	GetExistingIDs(ids []string) (map[string]bool, error)
+	GetMessageStamps(ctx context.Context, from int64, to int64) ([]Message, error)
+	GetMessagesBetween(ctx context.Context, topicName string, from int64, to int64) ([]Message, error)
+	GetNewestTimestamp(ctx context.Context) (int64, error)
+	IncrementDeliveries(ctx context.Context, consumer string, messageID string) (int, error)
+	DeleteDeliveries(ctx context.Context, consumer string, messageIDs []string) error
+	DeleteStaleDeliveries() (int64, error)
+	Snapshot(ctx context.Context) (Snapshot, error)
+}
+
+// Snapshot reads the messages as they were stored when it was taken,
+// it holds a database connection until it is released.
+type Snapshot interface {
+	ForEachBatch(fn func(messages []Message) error) error
+	Release()
 }
 
 func NewRepository(db *gorm.DB) Repository {
@@ -23,18 +48,28 @@ type repository struct {
 	db *gorm.DB
 }
 
-func (r *repository) CreateMessage(message *Message) error {
-	return r.db.Create(message).Error
+func (r *repository) CreateMessage(ctx context.Context, message *Message) error {
+	return r.db.WithContext(ctx).Create(message).Error
 }
 
-func (r *repository) GetMessages(topicName string, timestamp int64) <-chan []Message {
+func (r *repository) CreateMessages(ctx context.Context, messages []Message) error {
+	return r.db.WithContext(ctx).CreateInBatches(&messages, 100).Error
+}
+
+func (r *repository) GetMessages(ctx context.Context, topicName string, timestamp int64, filters ...Filter) <-chan []Message {
 	msgChan := make(chan []Message, 1)
 
 	go func() {
 		var messages []Message
 
+		query := r.db.WithContext(ctx).Where("topic = ? AND timestamp > ?", topicName, timestamp)
+		for _, filter := range filters {
+			condition, args := filter.sql()
+			query = query.Where(condition, args...)
+		}
+
 		// Processing records in batches of 50
-		result := r.db.Where("topic = ? AND timestamp > ?", topicName, timestamp).Order("timestamp").FindInBatches(&messages, 50, func(tx *gorm.DB, batch int) error {
+		result := query.Order("timestamp").FindInBatches(&messages, 50, func(tx *gorm.DB, batch int) error {
 			select {
 			case msgChan <- messages:
 				slog.Debug("Sending batch of messages", "topic", topicName, "batch", batch, "size", len(messages))
@@ -42,6 +77,9 @@ func (r *repository) GetMessages(topicName string, timestamp int64) <-chan []Mes
 			case <-time.After(1 * time.Second):
 				slog.Error("Timeout while getting messages from database")
 				return errors.New("timeout while getting messages from database")
+
+			case <-ctx.Done():
+				return ctx.Err()
 			}
 
 			return nil
@@ -56,3 +94,232 @@ func (r *repository) GetMessages(topicName string, timestamp int64) <-chan []Mes
 
 	return msgChan
 }
+
+func (r *repository) CommitOffset(ctx context.Context, offset *Offset) error {
+	return r.db.WithContext(ctx).Clauses(clause.OnConflict{
+		Columns:   []clause.Column{{Name: "subscription"}, {Name: "topic"}},
+		DoUpdates: clause.AssignmentColumns([]string{"timestamp"}),
+	}).Create(offset).Error
+}
+
+func (r *repository) GetOffsets(ctx context.Context, subscription string) (map[string]int64, error) {
+	var offsets []Offset
+	if err := r.db.WithContext(ctx).Where("subscription = ?", subscription).Find(&offsets).Error; err != nil {
+		return nil, err
+	}
+
+	topics := make(map[string]int64, len(offsets))
+	for _, offset := range offsets {
+		topics[offset.Topic] = offset.Timestamp
+	}
+
+	return topics, nil
+}
+
+func (r *repository) GetTopics() ([]string, error) {
+	var topics []string
+	if err := r.db.Model(&Message{}).Distinct().Pluck("topic", &topics).Error; err != nil {
+		return nil, err
+	}
+
+	return topics, nil
+}
+
+func (r *repository) DeleteMessages(topicName string, policy RetentionPolicy) (int64, error) {
+	var deleted int64
+
+	// Delete messages older than max age
+	if policy.MaxAge > 0 {
+		timestamp := time.Now().Add(-policy.MaxAge).UnixMicro()
+		result := r.db.Where("topic = ? AND timestamp < ?", topicName, timestamp).Delete(&Message{})
+		if result.Error != nil {
+			return deleted, result.Error
+		}
+		deleted += result.RowsAffected
+	}
+
+	// Keep only the newest max messages
+	if policy.MaxMessages > 0 {
+		newest := r.db.Model(&Message{}).Select("id").Where("topic = ?", topicName).Order("timestamp DESC").Limit(-1).Offset(int(policy.MaxMessages))
+		result := r.db.Where("topic = ? AND id IN (?)", topicName, newest).Delete(&Message{})
+		if result.Error != nil {
+			return deleted, result.Error
+		}
+		deleted += result.RowsAffected
+	}
+
+	// Keep only the newest messages that fit into max bytes
+	if policy.MaxBytes > 0 {
+		sizes := r.db.Model(&Message{}).Select("id, SUM(LENGTH(body)) OVER (ORDER BY timestamp DESC) AS total").Where("topic = ?", topicName)
+		oldest := r.db.Table("(?)", sizes).Select("id").Where("total > ?", policy.MaxBytes)
+		result := r.db.Where("topic = ? AND id IN (?)", topicName, oldest).Delete(&Message{})
+		if result.Error != nil {
+			return deleted, result.Error
+		}
+		deleted += result.RowsAffected
+	}
+
+	return deleted, nil
+}
+
+// GetRetentionHorizon returns the timestamp before which the policy deletes
+// messages of the topic, or 0 if it deletes none.
+func (r *repository) GetRetentionHorizon(topicName string, policy RetentionPolicy) (int64, error) {
+	var horizon int64
+	if policy.MaxAge > 0 {
+		horizon = time.Now().Add(-policy.MaxAge).UnixMicro()
+	}
+
+	// Once the topic is full, messages older than the oldest kept one are deleted
+	if policy.MaxMessages > 0 {
+		var timestamps []int64
+		err := r.db.Model(&Message{}).Where("topic = ?", topicName).Order("timestamp DESC").Offset(int(policy.MaxMessages)-1).Limit(1).Pluck("timestamp", &timestamps).Error
+		if err != nil {
+			return 0, err
+		}
+		if len(timestamps) > 0 {
+			horizon = max(horizon, timestamps[0])
+		}
+	}
+
+	if policy.MaxBytes > 0 {
+		var timestamps []int64
+		sizes := r.db.Model(&Message{}).Select("timestamp, SUM(LENGTH(body)) OVER (ORDER BY timestamp DESC) AS total").Where("topic = ?", topicName)
+		err := r.db.Table("(?)", sizes).Where("total >= ?", policy.MaxBytes).Order("timestamp DESC").Limit(1).Pluck("timestamp", &timestamps).Error
+		if err != nil {
+			return 0, err
+		}
+		if len(timestamps) > 0 {
+			horizon = max(horizon, timestamps[0])
+		}
+	}
+
+	return horizon, nil
+}
+
+func (r *repository) CompactMessages(ctx context.Context, topicName string, key string) (int64, error) {
+	db := r.db.WithContext(ctx)
+
+	// Keep only the newest message with the key
+	newest := db.Model(&Message{}).Select("id").Where("topic = ? AND key = ?", topicName, key).Order("timestamp DESC").Limit(1)
+	result := db.Where("topic = ? AND key = ? AND id NOT IN (?)", topicName, key, newest).Delete(&Message{})
+
+	return result.RowsAffected, result.Error
+}
+
+func (r *repository) GetMessageID(idempotencyKey string, timestamp int64) (string, error) {
+	// Oldest message with the key published after timestamp
+	var ids []string
+	err := r.db.Model(&Message{}).Where("idempotency_key = ? AND timestamp > ?", idempotencyKey, timestamp).Order("timestamp").Limit(1).Pluck("id", &ids).Error
+	if err != nil || len(ids) == 0 {
+		return "", err
+	}
+
+	return ids[0], nil
+}
+
+func (r *repository) GetExistingIDs(ids []string) (map[string]bool, error) {
+	var existing []string
+	if err := r.db.Model(&Message{}).Where("id IN ?", ids).Pluck("id", &existing).Error; err != nil {
+		return nil, err
+	}
+
+	result := make(map[string]bool, len(existing))
+	for _, id := range existing {
+		result[id] = true
+	}
+
+	return result, nil
+}
+
+// GetMessageStamps returns the ID, topic and timestamp of the messages
+// with timestamps in [from, to), without their bodies.
+func (r *repository) GetMessageStamps(ctx context.Context, from int64, to int64) ([]Message, error) {
+	var messages []Message
+	err := r.db.WithContext(ctx).Select("id", "topic", "timestamp").Where("timestamp >= ? AND timestamp < ?", from, to).Find(&messages).Error
+
+	return messages, err
+}
+
+func (r *repository) GetMessagesBetween(ctx context.Context, topicName string, from int64, to int64) ([]Message, error) {
+	var messages []Message
+	err := r.db.WithContext(ctx).Where("topic = ? AND timestamp >= ? AND timestamp < ?", topicName, from, to).Order("timestamp").Find(&messages).Error
+
+	return messages, err
+}
+
+// GetNewestTimestamp returns the timestamp of the newest stored message, or 0 without messages.
+func (r *repository) GetNewestTimestamp(ctx context.Context) (int64, error) {
+	var timestamp int64
+	err := r.db.WithContext(ctx).Model(&Message{}).Select("COALESCE(MAX(timestamp), 0)").Scan(&timestamp).Error
+
+	return timestamp, err
+}
+
+// IncrementDeliveries counts a delivery attempt of the message to the
+// consumer and returns the attempts so far.
+func (r *repository) IncrementDeliveries(ctx context.Context, consumer string, messageID string) (int, error) {
+	delivery := Delivery{Consumer: consumer, MessageID: messageID, Attempts: 1}
+
+	err := r.db.WithContext(ctx).Transaction(func(tx *gorm.DB) error {
+		err := tx.Clauses(clause.OnConflict{
+			Columns:   []clause.Column{{Name: "consumer"}, {Name: "message_id"}},
+			DoUpdates: clause.Assignments(map[string]interface{}{"attempts": gorm.Expr("attempts + 1")}),
+		}).Create(&delivery).Error
+		if err != nil {
+			return err
+		}
+
+		return tx.Where("consumer = ? AND message_id = ?", consumer, messageID).Take(&delivery).Error
+	})
+
+	return delivery.Attempts, err
+}
+
+func (r *repository) DeleteDeliveries(ctx context.Context, consumer string, messageIDs []string) error {
+	if len(messageIDs) == 0 {
+		return nil
+	}
+
+	return r.db.WithContext(ctx).Where("consumer = ? AND message_id IN ?", consumer, messageIDs).Delete(&Delivery{}).Error
+}
+
+// DeleteStaleDeliveries deletes the delivery attempts of messages that no longer exist.
+func (r *repository) DeleteStaleDeliveries() (int64, error) {
+	result := r.db.Where("message_id NOT IN (?)", r.db.Model(&Message{}).Select("id")).Delete(&Delivery{})
+
+	return result.RowsAffected, result.Error
+}
+
+// Snapshot starts a read transaction, which sees the messages stored at this point only.
+func (r *repository) Snapshot(ctx context.Context) (Snapshot, error) {
+	tx := r.db.WithContext(ctx).Begin()
+	if tx.Error != nil {
+		return nil, tx.Error
+	}
+
+	// SQLite fixes what a transaction sees at its first read
+	var count int64
+	if err := tx.Model(&Message{}).Count(&count).Error; err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+
+	return &snapshot{tx: tx}, nil
+}
+
+type snapshot struct {
+	tx *gorm.DB
+}
+
+// ForEachBatch calls fn with the messages in batches of 100, it stops at the first error.
+func (s *snapshot) ForEachBatch(fn func(messages []Message) error) error {
+	var messages []Message
+	return s.tx.FindInBatches(&messages, 100, func(tx *gorm.DB, batch int) error {
+		return fn(messages)
+	}).Error
+}
+
+func (s *snapshot) Release() {
+	s.tx.Rollback()
+}
@@ -0,0 +1,11 @@
+package data
+
+import "time"
+
+// RetentionPolicy limits how many messages of a topic are kept,
+// zero values mean no limit.
+type RetentionPolicy struct {
+	MaxAge      time.Duration
+	MaxBytes    int64
+	MaxMessages int64
+}
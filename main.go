@@ -34,11 +34,41 @@ func main() {
 	}
 
 	repo := data.NewRepository(db)
-	broker := services.NewBrokerService(repo)
-	consensus := services.NewConsensusService(cfg, broker)
+	broker := services.NewBrokerService(cfg, repo)
+	retention := services.NewRetentionService(cfg, repo)
+
+	certs, err := services.NewNodeCertificates(cfg)
+	if err != nil {
+		slog.Error("Failed to load node certificates", "error", err.Error())
+		return
+	}
+
+	// Consensus
+	var consensus services.ConsensusService
+	switch cfg.ConsensusEngine {
+	case "timestamp":
+		consensus = services.NewConsensusService(cfg, broker, repo, retention, certs)
+	case "raft":
+		consensus, err = services.NewRaftConsensusService(cfg, broker, repo, certs)
+		if err != nil {
+			slog.Error("Failed to create raft consensus service", "error", err.Error())
+			return
+		}
+	default:
+		slog.Error("Unknown consensus engine", "engine", cfg.ConsensusEngine)
+		return
+	}
+
+	authService, err := services.NewAuthService(cfg)
+	if err != nil {
+		slog.Error("Failed to create auth service", "error", err.Error())
+		return
+	}
+
+	peers := services.NewPeerVerifier(cfg, consensus)
 
 	// Broker Server
-	brokerSrv, brokerListener, err := api.NewBrokerServer(cfg, broker, consensus)
+	brokerSrv, brokerListener, err := api.NewBrokerServer(cfg, broker, consensus, retention, peers, authService)
 	if err != nil {
 		slog.Error("Failed to create broker server", "error", err.Error())
 		return
@@ -53,7 +83,7 @@ func main() {
 	}()
 
 	// Node Server
-	nodeSrv, nodeListener, err := api.NewNodeServer(cfg, consensus)
+	nodeSrv, nodeListener, err := api.NewNodeServer(cfg, consensus, certs, peers)
 	if err != nil {
 		slog.Error("Failed to create node server", "error", err.Error())
 		return
@@ -3,6 +3,7 @@ package models
 import (
 	"geo-distributed-message-broker/data"
 	"geo-distributed-message-broker/pb"
+	"time"
 )
 
 type ProposeRequest struct {
@@ -25,6 +26,7 @@ type ProposeResponse struct {
 	Ack          bool
 	Message      data.Message
 	Predecessors map[string]data.Message
+	Duplicate    string // ID of the message already published with the same idempotency key
 }
 
 func (r ProposeResponse) ToPb() *pb.ProposeResponse {
@@ -32,6 +34,7 @@ func (r ProposeResponse) ToPb() *pb.ProposeResponse {
 		Ack:          r.Ack,
 		Message:      messageToPb(r.Message),
 		Predecessors: messagesToPb(r.Predecessors),
+		Duplicate:    r.Duplicate,
 	}
 }
 
@@ -40,6 +43,7 @@ func ToProposeResponse(rsp *pb.ProposeResponse) ProposeResponse {
 		Ack:          rsp.Ack,
 		Message:      messageFromPb(rsp.Message),
 		Predecessors: messagesFromPb(rsp.Predecessors),
+		Duplicate:    rsp.Duplicate,
 	}
 }
 
@@ -62,12 +66,304 @@ func ToStableRequest(rsp *pb.StableRequest) StableRequest {
 	}
 }
 
+type ProposeBatchRequest struct {
+	Messages []data.Message
+}
+
+func (r ProposeBatchRequest) ToPb() *pb.ProposeBatchRequest {
+	return &pb.ProposeBatchRequest{
+		Messages: messageListToPb(r.Messages),
+	}
+}
+
+func ToProposeBatchRequest(req *pb.ProposeBatchRequest) ProposeBatchRequest {
+	return ProposeBatchRequest{
+		Messages: messageListFromPb(req.Messages),
+	}
+}
+
+type ProposeBatchResponse struct {
+	Ack          bool
+	Predecessors map[string]data.Message
+	Duplicates   map[string]string // map[message_id]original_message_id
+}
+
+func (r ProposeBatchResponse) ToPb() *pb.ProposeBatchResponse {
+	return &pb.ProposeBatchResponse{
+		Ack:          r.Ack,
+		Predecessors: messagesToPb(r.Predecessors),
+		Duplicates:   r.Duplicates,
+	}
+}
+
+func ToProposeBatchResponse(rsp *pb.ProposeBatchResponse) ProposeBatchResponse {
+	return ProposeBatchResponse{
+		Ack:          rsp.Ack,
+		Predecessors: messagesFromPb(rsp.Predecessors),
+		Duplicates:   rsp.Duplicates,
+	}
+}
+
+type StableBatchRequest struct {
+	Messages     []data.Message
+	Predecessors map[string]data.Message
+}
+
+func (r StableBatchRequest) ToPb() *pb.StableBatchRequest {
+	return &pb.StableBatchRequest{
+		Messages:     messageListToPb(r.Messages),
+		Predecessors: messagesToPb(r.Predecessors),
+	}
+}
+
+func ToStableBatchRequest(req *pb.StableBatchRequest) StableBatchRequest {
+	return StableBatchRequest{
+		Messages:     messageListFromPb(req.Messages),
+		Predecessors: messagesFromPb(req.Predecessors),
+	}
+}
+
+type ForwardRequest struct {
+	Messages []data.Message
+}
+
+func (r ForwardRequest) ToPb() *pb.ForwardRequest {
+	return &pb.ForwardRequest{
+		Messages: messageListToPb(r.Messages),
+	}
+}
+
+func ToForwardRequest(req *pb.ForwardRequest) ForwardRequest {
+	return ForwardRequest{
+		Messages: messageListFromPb(req.Messages),
+	}
+}
+
+type ForwardResponse struct {
+	IDs []string
+}
+
+func (r ForwardResponse) ToPb() *pb.ForwardResponse {
+	return &pb.ForwardResponse{
+		Ids: r.IDs,
+	}
+}
+
+func ToForwardResponse(rsp *pb.ForwardResponse) ForwardResponse {
+	return ForwardResponse{
+		IDs: rsp.Ids,
+	}
+}
+
+type DigestRequest struct {
+	From   int64
+	To     int64
+	Bucket int64 // width of a bucket in microseconds
+}
+
+func (r DigestRequest) ToPb() *pb.DigestRequest {
+	return &pb.DigestRequest{
+		From:   r.From,
+		To:     r.To,
+		Bucket: r.Bucket,
+	}
+}
+
+func ToDigestRequest(req *pb.DigestRequest) DigestRequest {
+	return DigestRequest{
+		From:   req.From,
+		To:     req.To,
+		Bucket: req.Bucket,
+	}
+}
+
+// Digest summarizes the messages of a topic in a bucket of timestamps.
+type Digest struct {
+	Topic string
+	From  int64  // first timestamp of the bucket
+	Count int64  // number of messages
+	Hash  uint64 // xor of the hashes of the message IDs
+}
+
+type DigestResponse struct {
+	Digests []Digest
+}
+
+func (r DigestResponse) ToPb() *pb.DigestResponse {
+	digests := make([]*pb.Digest, 0, len(r.Digests))
+	for _, digest := range r.Digests {
+		digests = append(digests, &pb.Digest{
+			Topic: digest.Topic,
+			From:  digest.From,
+			Count: digest.Count,
+			Hash:  digest.Hash,
+		})
+	}
+
+	return &pb.DigestResponse{
+		Digests: digests,
+	}
+}
+
+func ToDigestResponse(rsp *pb.DigestResponse) DigestResponse {
+	digests := make([]Digest, 0, len(rsp.Digests))
+	for _, digest := range rsp.Digests {
+		digests = append(digests, Digest{
+			Topic: digest.Topic,
+			From:  digest.From,
+			Count: digest.Count,
+			Hash:  digest.Hash,
+		})
+	}
+
+	return DigestResponse{
+		Digests: digests,
+	}
+}
+
+type PullRequest struct {
+	Topic string
+	From  int64
+	To    int64
+	IDs   []string // messages the puller already has
+}
+
+func (r PullRequest) ToPb() *pb.PullRequest {
+	return &pb.PullRequest{
+		Topic: r.Topic,
+		From:  r.From,
+		To:    r.To,
+		Ids:   r.IDs,
+	}
+}
+
+func ToPullRequest(req *pb.PullRequest) PullRequest {
+	return PullRequest{
+		Topic: req.Topic,
+		From:  req.From,
+		To:    req.To,
+		IDs:   req.Ids,
+	}
+}
+
+type PullResponse struct {
+	Messages []data.Message
+	More     bool // the response was cut short and more messages are missing
+}
+
+func (r PullResponse) ToPb() *pb.PullResponse {
+	return &pb.PullResponse{
+		Messages: messageListToPb(r.Messages),
+		More:     r.More,
+	}
+}
+
+func ToPullResponse(rsp *pb.PullResponse) PullResponse {
+	return PullResponse{
+		Messages: messageListFromPb(rsp.Messages),
+		More:     rsp.More,
+	}
+}
+
+// AbortRequest withdraws proposals that will never become stable.
+type AbortRequest struct {
+	Messages []data.Message
+}
+
+func (r AbortRequest) ToPb() *pb.AbortRequest {
+	return &pb.AbortRequest{
+		Messages: messageListToPb(r.Messages),
+	}
+}
+
+func ToAbortRequest(req *pb.AbortRequest) AbortRequest {
+	return AbortRequest{
+		Messages: messageListFromPb(req.Messages),
+	}
+}
+
+// Membership lists the node addresses of the whole cluster.
+type Membership struct {
+	Version  int64             // increases with every change
+	Nodes    []string          // nodes voting in consensus
+	Learners []string          // nodes catching up before they vote
+	Regions  map[string]string // map[node_host]region, nodes without a region share an unnamed one
+}
+
+func (m Membership) ToPb() *pb.MembershipRequest {
+	return &pb.MembershipRequest{
+		Version:  m.Version,
+		Nodes:    m.Nodes,
+		Learners: m.Learners,
+		Regions:  m.Regions,
+	}
+}
+
+func ToMembership(req *pb.MembershipRequest) Membership {
+	regions := req.Regions
+	if regions == nil {
+		regions = map[string]string{}
+	}
+
+	return Membership{
+		Version:  req.Version,
+		Nodes:    req.Nodes,
+		Learners: req.Learners,
+		Regions:  regions,
+	}
+}
+
+// NodeHealth is the state of a node in the failure detector.
+type NodeHealth struct {
+	Alive    bool
+	Phi      float64 // suspicion that the node is down, grows with its silence
+	LastSeen time.Time
+	RTT      time.Duration // smoothed round trip of heartbeats
+	Info     NodeInfo      // reported by the node in its latest heartbeat
+}
+
+// NodeInfo is what a node reports about itself in heartbeats.
+type NodeInfo struct {
+	BrokerAddress string // address clients reach the node at
+	Region        string
+	Zone          string
+}
+
+func (i NodeInfo) ToPb() *pb.HeartbeatResponse {
+	return &pb.HeartbeatResponse{
+		BrokerAddress: i.BrokerAddress,
+		Region:        i.Region,
+		Zone:          i.Zone,
+	}
+}
+
+func ToNodeInfo(rsp *pb.HeartbeatResponse) NodeInfo {
+	return NodeInfo{
+		BrokerAddress: rsp.BrokerAddress,
+		Region:        rsp.Region,
+		Zone:          rsp.Zone,
+	}
+}
+
+// Endpoint is a node clients can connect to, as seen by the node answering.
+type Endpoint struct {
+	Node          string // address of the node for other nodes
+	BrokerAddress string // empty until the node answered a heartbeat
+	Region        string
+	Zone          string
+	Alive         bool
+	RTT           time.Duration // 0 for the answering node itself
+}
+
 func messageToPb(msg data.Message) *pb.Message {
 	return &pb.Message{
-		Id:        msg.ID,
-		Timestamp: msg.Timestamp,
-		Topic:     msg.Topic,
-		Body:      msg.Body,
+		Id:             msg.ID,
+		Timestamp:      msg.Timestamp,
+		Topic:          msg.Topic,
+		Key:            msg.Key,
+		Body:           msg.Body,
+		Headers:        msg.Headers,
+		IdempotencyKey: msg.IdempotencyKey,
 	}
 }
 
@@ -81,12 +377,25 @@ func messagesToPb(msgs map[string]data.Message) map[string]*pb.Message {
 	return messages
 }
 
+func messageListToPb(msgs []data.Message) []*pb.Message {
+	messages := make([]*pb.Message, 0, len(msgs))
+
+	for _, msg := range msgs {
+		messages = append(messages, messageToPb(msg))
+	}
+
+	return messages
+}
+
 func messageFromPb(msg *pb.Message) data.Message {
 	return data.Message{
-		ID:        msg.Id,
-		Timestamp: msg.Timestamp,
-		Topic:     msg.Topic,
-		Body:      msg.Body,
+		ID:             msg.Id,
+		Timestamp:      msg.Timestamp,
+		Topic:          msg.Topic,
+		Key:            msg.Key,
+		Body:           msg.Body,
+		Headers:        msg.Headers,
+		IdempotencyKey: msg.IdempotencyKey,
 	}
 }
 
@@ -99,3 +408,65 @@ func messagesFromPb(msgs map[string]*pb.Message) map[string]data.Message {
 
 	return messages
 }
+
+func messageListFromPb(msgs []*pb.Message) []data.Message {
+	messages := make([]data.Message, 0, len(msgs))
+
+	for _, msg := range msgs {
+		messages = append(messages, messageFromPb(msg))
+	}
+
+	return messages
+}
+
+type SubscribeRequest struct {
+	Topics       map[string]int64
+	Group        string
+	Subscription string
+	Filters      []data.Filter
+	Ack          bool
+}
+
+func ToSubscribeRequest(req *pb.SubscribeRequest) SubscribeRequest {
+	return SubscribeRequest{
+		Topics:       req.Topics,
+		Group:        req.Group,
+		Subscription: req.Subscription,
+		Filters:      filtersFromPb(req.Filters),
+	}
+}
+
+func filtersFromPb(filters []*pb.Filter) []data.Filter {
+	result := make([]data.Filter, 0, len(filters))
+
+	for _, f := range filters {
+		operator := data.FilterEquals
+		if f.Operator == pb.Filter_PREFIX {
+			operator = data.FilterPrefix
+		}
+
+		result = append(result, data.Filter{
+			Field:    f.Field,
+			Operator: operator,
+			Value:    f.Value,
+		})
+	}
+
+	return result
+}
+
+func RetentionPolicyToPb(policy data.RetentionPolicy) *pb.RetentionPolicy {
+	return &pb.RetentionPolicy{
+		MaxAgeSeconds: int64(policy.MaxAge / time.Second),
+		MaxBytes:      policy.MaxBytes,
+		MaxMessages:   policy.MaxMessages,
+	}
+}
+
+func ToRetentionPolicy(policy *pb.RetentionPolicy) data.RetentionPolicy {
+	return data.RetentionPolicy{
+		MaxAge:      time.Duration(policy.GetMaxAgeSeconds()) * time.Second,
+		MaxBytes:    policy.GetMaxBytes(),
+		MaxMessages: policy.GetMaxMessages(),
+	}
+}
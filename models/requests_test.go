@@ -0,0 +1,58 @@
+package models
+
+import (
+	"geo-distributed-message-broker/data"
+	"geo-distributed-message-broker/pb"
+	"reflect"
+	"testing"
+
+	"google.golang.org/protobuf/proto"
+)
+
+func TestMessageHeadersRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		headers map[string]string
+	}{
+		{name: "without headers", headers: nil},
+		{name: "one header", headers: map[string]string{"trace_id": "abc"}},
+		{name: "several headers", headers: map[string]string{"trace_id": "abc", "content-type": "application/json", "empty": ""}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			msg := data.Message{ID: "m1", Topic: "orders", Timestamp: 1, Body: []byte("order"), Headers: tt.headers}
+			req := StableBatchRequest{
+				Messages:     []data.Message{msg},
+				Predecessors: map[string]data.Message{"m0": {ID: "m0", Topic: "orders", Headers: tt.headers}},
+			}
+
+			// Send the request over the wire like a node does
+			wire, err := proto.Marshal(req.ToPb())
+			if err != nil {
+				t.Fatal(err)
+			}
+			var decoded pb.StableBatchRequest
+			if err := proto.Unmarshal(wire, &decoded); err != nil {
+				t.Fatal(err)
+			}
+			got := ToStableBatchRequest(&decoded)
+
+			if len(got.Messages) != 1 || !sameHeaders(got.Messages[0].Headers, tt.headers) {
+				t.Errorf("message headers = %v, want %v", got.Messages, tt.headers)
+			}
+			if !sameHeaders(got.Predecessors["m0"].Headers, tt.headers) {
+				t.Errorf("predecessor headers = %v, want %v", got.Predecessors["m0"].Headers, tt.headers)
+			}
+		})
+	}
+}
+
+// sameHeaders treats nil and empty headers as equal, like protobuf does.
+func sameHeaders(got, want map[string]string) bool {
+	if len(got) == 0 && len(want) == 0 {
+		return true
+	}
+
+	return reflect.DeepEqual(got, want)
+}
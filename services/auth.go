@@ -0,0 +1,320 @@
+package services
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geo-distributed-message-broker/config"
+	"log/slog"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/pbkdf2"
+)
+
+const (
+	PASSWORD_HASH_SCHEME     = "pbkdf2-sha256"
+	PASSWORD_HASH_ITERATIONS = 600000
+	PASSWORD_SALT_SIZE       = 16
+	SESSION_TOKEN_SIZE       = 32
+)
+
+var ErrInvalidCredentials = errors.New("invalid username or password")
+var ErrInvalidSession = errors.New("invalid or expired session token")
+
+type AuthService interface {
+	Authenticate(username string, password string) (User, error)
+	NewSession(user User) (string, error)
+	AuthenticateSession(token string) (User, error)
+	AuthenticateToken(token string) (User, error)
+	AuthenticateCertificate(cert *x509.Certificate) (User, error)
+}
+
+// User is a principal with the topics it may publish to and subscribe to,
+// granted as topic names or wildcard patterns like "orders.>".
+type User struct {
+	Name      string   `json:"name"`
+	Password  string   `json:"password"` // hashed with HashPassword, empty for users with client certificates only
+	Subjects  []string `json:"subjects"` // client certificate subjects, e.g. "CN=orders-service,O=Example"
+	Publish   []string `json:"publish"`
+	Subscribe []string `json:"subscribe"`
+	Admin     bool     `json:"admin"` // may change retention policies and membership
+}
+
+// CanPublish reports whether the user may publish to the topic.
+func (u User) CanPublish(topic string) bool {
+	return granted(u.Publish, topic)
+}
+
+// CanSubscribe reports whether the user may subscribe to the topic or pattern,
+// a pattern must be covered by a single grant.
+func (u User) CanSubscribe(topic string) bool {
+	return granted(u.Subscribe, topic)
+}
+
+func granted(grants []string, topic string) bool {
+	for _, grant := range grants {
+		if CoversTopic(grant, topic) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func NewAuthService(cfg config.Config) (AuthService, error) {
+	slog.Info("Creating new auth service 🔐")
+
+	tokens, err := newTokenVerifier(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	// Unknown users are checked against a hash of a random password,
+	// so they take as long as known users with a wrong password
+	secret := make([]byte, PASSWORD_SALT_SIZE)
+	if _, err := rand.Read(secret); err != nil {
+		return nil, err
+	}
+	dummy, err := HashPassword(string(secret))
+	if err != nil {
+		return nil, err
+	}
+
+	a := &authService{
+		users:      make(map[string]User),
+		subjects:   make(map[string]string),
+		sessions:   make(map[[32]byte]session),
+		sessionTTL: cfg.SessionTTL,
+		tokens:     tokens,
+		dummy:      dummy,
+		hashing:    make(chan struct{}, runtime.NumCPU()),
+	}
+	if a.sessionTTL > 0 {
+		time.AfterFunc(a.sessionTTL, a.SessionCleanupJob)
+	}
+	if tokens != nil {
+		slog.Info("Accepting bearer tokens", "keys", len(tokens.keys), "audience", cfg.JWTAudience)
+	}
+
+	// Without a users file the configured user may do everything
+	if cfg.UsersFile == "" {
+		password, err := HashPassword(cfg.Password)
+		if err != nil {
+			return nil, err
+		}
+
+		a.users[cfg.Username] = User{
+			Name:      cfg.Username,
+			Password:  password,
+			Publish:   []string{MULTI_WILDCARD},
+			Subscribe: []string{MULTI_WILDCARD},
+			Admin:     true,
+		}
+
+		return a, nil
+	}
+
+	content, err := os.ReadFile(cfg.UsersFile)
+	if err != nil {
+		return nil, err
+	}
+
+	var file struct {
+		Users []User `json:"users"`
+	}
+	if err := json.Unmarshal(content, &file); err != nil {
+		return nil, fmt.Errorf("failed to parse users file %s: %w", cfg.UsersFile, err)
+	}
+
+	for _, user := range file.Users {
+		if user.Password == "" && len(user.Subjects) == 0 {
+			return nil, fmt.Errorf("user %s needs a password or a certificate subject", user.Name)
+		}
+		if _, _, _, err := parsePasswordHash(user.Password); user.Password != "" && err != nil {
+			return nil, fmt.Errorf("invalid password of user %s: %w", user.Name, err)
+		}
+		if _, ok := a.users[user.Name]; ok {
+			return nil, fmt.Errorf("duplicate user %s", user.Name)
+		}
+
+		for _, subject := range user.Subjects {
+			if other, ok := a.subjects[subject]; ok {
+				return nil, fmt.Errorf("subject %s of user %s already belongs to user %s", subject, user.Name, other)
+			}
+			a.subjects[subject] = user.Name
+		}
+		a.users[user.Name] = user
+	}
+
+	slog.Info("Loaded users", "path", cfg.UsersFile, "users", len(a.users))
+
+	return a, nil
+}
+
+type authService struct {
+	users      map[string]User      // map[username]User
+	subjects   map[string]string    // map[certificate_subject]username
+	sessions   map[[32]byte]session // map[sha256(session_token)]session
+	sessionTTL time.Duration        // 0 disables sessions
+	mu         sync.RWMutex         // protects sessions
+	tokens     *tokenVerifier       // nil without token keys
+	dummy      string               // password hash checked for unknown users
+	hashing    chan struct{}        // one slot per password hashed at the same time
+}
+
+// session lets a client skip hashing its password on every request.
+type session struct {
+	user    User
+	expires time.Time
+}
+
+// Authenticate checks a password against its hash, which is slow on purpose,
+// so clients should continue with a session token. Passwords are hashed
+// one per CPU at a time, so password guessing cannot starve other requests.
+func (a *authService) Authenticate(username string, password string) (User, error) {
+	user, ok := a.users[username]
+	hash := user.Password
+	if !ok || hash == "" {
+		hash = a.dummy
+	}
+
+	a.hashing <- struct{}{}
+	valid := verifyPassword(hash, password)
+	<-a.hashing
+
+	if !ok || user.Password == "" || !valid {
+		return User{}, ErrInvalidCredentials
+	}
+
+	return user, nil
+}
+
+// NewSession returns a random token authenticating the user until the session
+// expires, or an empty token if sessions are disabled. Only a hash of the token is kept.
+func (a *authService) NewSession(user User) (string, error) {
+	if a.sessionTTL <= 0 {
+		return "", nil
+	}
+
+	token := make([]byte, SESSION_TOKEN_SIZE)
+	if _, err := rand.Read(token); err != nil {
+		return "", err
+	}
+	encoded := base64.RawURLEncoding.EncodeToString(token)
+
+	a.mu.Lock()
+	a.sessions[sha256.Sum256([]byte(encoded))] = session{
+		user:    user,
+		expires: time.Now().Add(a.sessionTTL),
+	}
+	a.mu.Unlock()
+
+	return encoded, nil
+}
+
+func (a *authService) AuthenticateSession(token string) (User, error) {
+	a.mu.RLock()
+	s, ok := a.sessions[sha256.Sum256([]byte(token))]
+	a.mu.RUnlock()
+
+	if !ok || time.Now().After(s.expires) {
+		return User{}, ErrInvalidSession
+	}
+
+	return s.user, nil
+}
+
+func (a *authService) SessionCleanupJob() {
+	defer time.AfterFunc(a.sessionTTL, a.SessionCleanupJob)
+
+	now := time.Now()
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	for key, s := range a.sessions {
+		if now.After(s.expires) {
+			delete(a.sessions, key)
+		}
+	}
+}
+
+func (a *authService) AuthenticateToken(token string) (User, error) {
+	if a.tokens == nil {
+		return User{}, errors.New("bearer tokens are not enabled")
+	}
+
+	return a.tokens.verify(token)
+}
+
+// AuthenticateCertificate returns the user of a verified client certificate,
+// matched by its full subject or by its common name alone as "CN=<name>".
+func (a *authService) AuthenticateCertificate(cert *x509.Certificate) (User, error) {
+	for _, subject := range []string{cert.Subject.String(), "CN=" + cert.Subject.CommonName} {
+		if name, ok := a.subjects[subject]; ok {
+			return a.users[name], nil
+		}
+	}
+
+	return User{}, fmt.Errorf("unknown certificate subject %s", cert.Subject.String())
+}
+
+// HashPassword returns a salted PBKDF2 hash of the password,
+// formatted as "pbkdf2-sha256$iterations$salt$hash".
+func HashPassword(password string) (string, error) {
+	salt := make([]byte, PASSWORD_SALT_SIZE)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash := pbkdf2.Key([]byte(password), salt, PASSWORD_HASH_ITERATIONS, sha256.Size, sha256.New)
+
+	return fmt.Sprintf("%s$%d$%s$%s",
+		PASSWORD_HASH_SCHEME,
+		PASSWORD_HASH_ITERATIONS,
+		base64.RawStdEncoding.EncodeToString(salt),
+		base64.RawStdEncoding.EncodeToString(hash),
+	), nil
+}
+
+func verifyPassword(encoded string, password string) bool {
+	iterations, salt, hash, err := parsePasswordHash(encoded)
+	if err != nil {
+		return false
+	}
+
+	return subtle.ConstantTimeCompare(pbkdf2.Key([]byte(password), salt, iterations, len(hash), sha256.New), hash) == 1
+}
+
+func parsePasswordHash(encoded string) (int, []byte, []byte, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) != 4 || parts[0] != PASSWORD_HASH_SCHEME {
+		return 0, nil, nil, fmt.Errorf("password must be a %s hash", PASSWORD_HASH_SCHEME)
+	}
+
+	iterations, err := strconv.Atoi(parts[1])
+	if err != nil || iterations < 1 {
+		return 0, nil, nil, errors.New("invalid iterations")
+	}
+
+	salt, err := base64.RawStdEncoding.DecodeString(parts[2])
+	if err != nil {
+		return 0, nil, nil, errors.New("invalid salt")
+	}
+
+	hash, err := base64.RawStdEncoding.DecodeString(parts[3])
+	if err != nil || len(hash) == 0 {
+		return 0, nil, nil, errors.New("invalid hash")
+	}
+
+	return iterations, salt, hash, nil
+}
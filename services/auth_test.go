@@ -0,0 +1,77 @@
+package services
+
+import (
+	"errors"
+	"geo-distributed-message-broker/config"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Hash of "pw1" written by an earlier release, existing users files must keep working.
+const testPasswordHash = "pbkdf2-sha256$600000$haSo0ksGDivtR9WnnwFQ/w$9IH7oC6B0jansBChX1WSCvWPNkfaWqK91yrp1+wLN74"
+
+func newTestAuthService(t *testing.T) AuthService {
+	t.Helper()
+
+	path := filepath.Join(t.TempDir(), "users.json")
+	users := `{"users": [
+		{"name": "ops", "password": "` + testPasswordHash + `", "publish": [">"], "admin": true},
+		{"name": "orders-service", "subjects": ["CN=orders-service"], "publish": ["orders.>"]}
+	]}`
+	if err := os.WriteFile(path, []byte(users), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	a, err := NewAuthService(config.Config{UsersFile: path})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestAuthService(t)
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		err      error
+	}{
+		{name: "valid password", username: "ops", password: "pw1"},
+		{name: "wrong password", username: "ops", password: "pw2", err: ErrInvalidCredentials},
+		{name: "unknown user", username: "nobody", password: "pw1", err: ErrInvalidCredentials},
+		{name: "user without password", username: "orders-service", password: "", err: ErrInvalidCredentials},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			user, err := a.Authenticate(tt.username, tt.password)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.err)
+			}
+			if tt.err == nil && user.Name != tt.username {
+				t.Errorf("user name = %s, want %s", user.Name, tt.username)
+			}
+		})
+	}
+}
+
+func TestHashPassword(t *testing.T) {
+	hash, err := HashPassword("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !verifyPassword(hash, "secret") {
+		t.Error("verifyPassword() = false for the hashed password")
+	}
+	if verifyPassword(hash, "other") {
+		t.Error("verifyPassword() = true for another password")
+	}
+	if verifyPassword("sha256$1$c2FsdA$aGFzaA", "secret") {
+		t.Error("verifyPassword() = true for another scheme")
+	}
+}
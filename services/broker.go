@@ -1,36 +1,171 @@
 package services
 
 import (
+	"context"
+	"geo-distributed-message-broker/config"
 	"geo-distributed-message-broker/data"
+	"geo-distributed-message-broker/models"
 	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type BrokerService interface {
-	Publish(msg data.Message) (string, error)
-	Subscribe(topics map[string]int64) (<-chan data.Message, string, error)
-	Unsubscribe(subscriberID string, topics map[string]int64)
+	Publish(ctx context.Context, msg data.Message) (string, error)
+	PublishBatch(ctx context.Context, msgs []data.Message) ([]string, error)
+	Store(ctx context.Context, msgs []data.Message) error
+	Resume(ctx context.Context, req models.SubscribeRequest) (models.SubscribeRequest, error)
+	Subscribe(ctx context.Context, req models.SubscribeRequest) (<-chan data.Message, string, error)
+	Unsubscribe(subscriberID string)
+	Commit(ctx context.Context, offset data.Offset) error
+	Deliver(ctx context.Context, subscriberID string, msg data.Message) bool
+	Ack(subscriberID string, ids []string)
+	Nack(subscriberID string, ids []string)
+	DeadLetters() <-chan data.Message
+	Deduplicate(idempotencyKey string) (string, bool)
 }
 
-func NewBrokerService(repo data.Repository) BrokerService {
+const REDELIVERY_INTERVAL = 1 * time.Second
+const DEAD_LETTER_SUFFIX = ".dlq"
+
+// MAX_ORPHANED_MESSAGES bounds the unacked messages kept for a group without
+// members, the oldest ones are dropped first.
+const MAX_ORPHANED_MESSAGES = 1000
+
+func NewBrokerService(cfg config.Config, repo data.Repository) BrokerService {
 	slog.Info("Creating new broker 📬")
 
+	compacted := make(map[string]bool, len(cfg.CompactedTopics))
+	for _, topic := range cfg.CompactedTopics {
+		compacted[topic] = true
+	}
+
 	return &brokerService{
-		topics: map[string]map[string]chan data.Message{},
-		repo:   repo,
+		topics:              map[string]map[string]chan data.Message{},
+		groups:              map[string]map[string]*group{},
+		subscribers:         map[string]models.SubscribeRequest{},
+		wildcards:           map[string]bool{},
+		inflight:            map[string]*inflight{},
+		senders:             map[string]*sender{},
+		orphans:             map[string]map[string][]data.Message{},
+		deadLetters:         make(chan data.Message, 100),
+		visibilityTimeout:   cfg.VisibilityTimeout,
+		maxAttempts:         cfg.MaxDeliveryAttempts,
+		topicMaxAttempts:    cfg.TopicMaxDeliveryAttempts,
+		compacted:           compacted,
+		deduplicationWindow: cfg.DeduplicationWindow,
+		repo:                repo,
 	}
 }
 
 type brokerService struct {
-	topics map[string]map[string]chan data.Message // map[topic_name]map[subscriber_id]chan data.Message
-	mu     sync.RWMutex                            // protects topics
-	repo   data.Repository
+	topics              map[string]map[string]chan data.Message // map[topic_name]map[subscriber_id]chan data.Message
+	groups              map[string]map[string]*group            // map[topic_name]map[group_name]*group
+	subscribers         map[string]models.SubscribeRequest      // map[subscriber_id]SubscribeRequest
+	wildcards           map[string]bool                         // map[topic_pattern]subscribed, patterns also used as keys of topics and groups
+	inflight            map[string]*inflight                    // map[subscriber_id]*inflight
+	senders             map[string]*sender                      // map[subscriber_id]*sender
+	orphans             map[string]map[string][]data.Message    // map[topic_name]map[group_name][]data.Message, unacked messages of groups without members
+	mu                  sync.RWMutex                            // protects topics, groups, subscribers, wildcards, inflight, senders and orphans
+	deadLetters         chan data.Message                       // messages to republish on their dead-letter topic
+	visibilityTimeout   time.Duration
+	maxAttempts         int             // default max delivery attempts, 0 means unlimited
+	topicMaxAttempts    map[string]int  // map[topic_name]max_delivery_attempts
+	compacted           map[string]bool // map[topic_name]keep_only_newest_message_per_key
+	deduplicationWindow time.Duration   // 0 disables deduplication
+	repo                data.Repository
+}
+
+// inflight tracks the messages sent to an acknowledging subscriber
+// that were not acked yet, so they can be redelivered on timeout.
+type inflight struct {
+	consumer   string // key of the persisted delivery attempts, see deliveryConsumer
+	subscriber chan data.Message
+	messages   map[string]inflightMessage // map[message_id]inflightMessage
+	mu         sync.Mutex                 // protects messages
+	done       chan struct{}              // closed when the subscriber leaves
+}
+
+// sender sends published messages to a subscriber. Messages are sent without
+// holding the broker's lock, the sender's own lock keeps batches contiguous.
+type sender struct {
+	subscriberID string
+	subscriber   chan data.Message
+	mu           sync.Mutex    // held while sending
+	done         chan struct{} // closed when the subscriber leaves
+}
+
+func (s *sender) send(msg data.Message) {
+	select {
+	case s.subscriber <- msg:
+	case <-s.done:
+	}
+}
+
+type inflightMessage struct {
+	message    data.Message
+	deliveries int
+	deadline   time.Time
+}
+
+// group is a consumer group on a single topic of this node, every message
+// published to the topic is delivered to exactly one of its members.
+type group struct {
+	members  []string                     // subscriber ids in join order
+	channels map[string]chan data.Message // map[subscriber_id]chan data.Message
+	next     atomic.Uint64                // round-robin cursor over members
+	ctx      context.Context              // done when the last member leaves, stops replaying history
+	cancel   context.CancelFunc
+}
+
+func (g *group) join(subscriberID string, subscriber chan data.Message) {
+	if _, ok := g.channels[subscriberID]; ok {
+		return
+	}
+
+	g.members = append(g.members, subscriberID)
+	g.channels[subscriberID] = subscriber
 }
 
-func (b *brokerService) Publish(msg data.Message) (string, error) {
+func (g *group) leave(subscriberID string) {
+	if _, ok := g.channels[subscriberID]; !ok {
+		return
+	}
+
+	delete(g.channels, subscriberID)
+	for i, id := range g.members {
+		if id == subscriberID {
+			g.members = append(g.members[:i], g.members[i+1:]...)
+			break
+		}
+	}
+}
+
+// pick returns the next member in round-robin order that accepts the message.
+func (g *group) pick(accepts func(subscriberID string) bool) (string, bool) {
+	n := uint64(len(g.members))
+	if n == 0 {
+		return "", false
+	}
+
+	start := g.next.Add(1) - 1
+	for i := uint64(0); i < n; i++ {
+		subscriberID := g.members[(start+i)%n]
+		if accepts(subscriberID) {
+			return subscriberID, true
+		}
+	}
+
+	return "", false
+}
+
+func (b *brokerService) Publish(ctx context.Context, msg data.Message) (string, error) {
 	// Generate message ID if not provided
 	if msg.ID == "" {
 		msg.ID = uuid.NewString()
@@ -50,73 +185,798 @@ func (b *brokerService) Publish(msg data.Message) (string, error) {
 	}
 	b.mu.Unlock()
 
-	err := b.repo.CreateMessage(&msg)
+	err := b.repo.CreateMessage(ctx, &msg)
 	if err != nil {
 		return "", err
 	}
 
-	// Send message to all subscribers
-	b.mu.RLock()
-	for _, subscriber := range b.topics[msg.Topic] {
-		subscriber <- msg
+	// Drop older messages with the same key from compacted topics
+	if msg.Key != "" && b.compacted[msg.Topic] {
+		if _, err := b.repo.CompactMessages(ctx, msg.Topic, msg.Key); err != nil {
+			slog.Error("Failed to compact messages", "topic", msg.Topic, "key", msg.Key, "error", err.Error())
+		}
 	}
+
+	b.mu.RLock()
+	senders := b.recipients(msg)
 	b.mu.RUnlock()
 
+	send([]data.Message{msg}, [][]*sender{senders})
+
 	return msg.ID, nil
 }
 
-func (b *brokerService) Subscribe(topics map[string]int64) (<-chan data.Message, string, error) {
+func (b *brokerService) PublishBatch(ctx context.Context, msgs []data.Message) ([]string, error) {
+	ids := make([]string, len(msgs))
+	timestamp := time.Now().UnixMicro()
+	for i := range msgs {
+		// Generate message ID if not provided
+		if msgs[i].ID == "" {
+			msgs[i].ID = uuid.NewString()
+		}
+
+		// Set consecutive timestamps if not provided
+		if msgs[i].Timestamp == 0 {
+			msgs[i].Timestamp = timestamp + int64(i)
+		}
+
+		ids[i] = msgs[i].ID
+	}
+
+	slog.Debug("Publishing batch", "messages", len(msgs))
+
+	if err := b.Store(ctx, msgs); err != nil {
+		return nil, err
+	}
+
+	b.mu.RLock()
+	senders := make([][]*sender, len(msgs))
+	for i, msg := range msgs {
+		senders[i] = b.recipients(msg)
+	}
+	b.mu.RUnlock()
+
+	send(msgs, senders)
+
+	return ids, nil
+}
+
+// Store stores messages without sending them to subscribers, e.g. old messages
+// a node missed. Subscribers replaying the topics from an earlier offset get them.
+func (b *brokerService) Store(ctx context.Context, msgs []data.Message) error {
+	// Create topics if they do not exist
+	b.mu.Lock()
+	for _, msg := range msgs {
+		if _, ok := b.topics[msg.Topic]; !ok {
+			b.topics[msg.Topic] = map[string]chan data.Message{}
+		}
+	}
+	b.mu.Unlock()
+
+	err := b.repo.CreateMessages(ctx, msgs)
+	if err != nil {
+		return err
+	}
+
+	// Drop older messages with the same key from compacted topics,
+	// a stored message older than the newest one is dropped itself
+	for _, msg := range msgs {
+		if msg.Key != "" && b.compacted[msg.Topic] {
+			if _, err := b.repo.CompactMessages(ctx, msg.Topic, msg.Key); err != nil {
+				slog.Error("Failed to compact messages", "topic", msg.Topic, "key", msg.Key, "error", err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+// recipients returns the senders of the subscribers a message is delivered to,
+// the caller must hold mu.
+func (b *brokerService) recipients(msg data.Message) []*sender {
+	// Collect the topic itself and every wildcard pattern matching it
+	keys := []string{msg.Topic}
+	for pattern := range b.wildcards {
+		if MatchTopic(pattern, msg.Topic) {
+			keys = append(keys, pattern)
+		}
+	}
+
+	// Pick all subscribers and one member of every group,
+	// at most once even if several of their topics match
+	var recipients []*sender
+	delivered := map[string]bool{}       // map[subscriber_id]delivered
+	deliveredGroups := map[string]bool{} // map[group_name]delivered
+	for _, key := range keys {
+		for subscriberID := range b.topics[key] {
+			if delivered[subscriberID] {
+				continue
+			}
+
+			// Skip subscribers that asked to start after this message
+			if msg.Timestamp < b.subscribers[subscriberID].Topics[key] {
+				slog.Warn("Skipping message", "subscriber", subscriberID, "message", msg.ID)
+				continue
+			}
+
+			// Skip subscribers whose filters do not match
+			if !data.Match(b.subscribers[subscriberID].Filters, msg) {
+				continue
+			}
+
+			delivered[subscriberID] = true
+			recipients = append(recipients, b.senders[subscriberID])
+		}
+		for name, g := range b.groups[key] {
+			if deliveredGroups[name] {
+				continue
+			}
+
+			accepts := func(subscriberID string) bool {
+				return !delivered[subscriberID] && data.Match(b.subscribers[subscriberID].Filters, msg)
+			}
+			if subscriberID, ok := g.pick(accepts); ok {
+				delivered[subscriberID] = true
+				deliveredGroups[name] = true
+				recipients = append(recipients, b.senders[subscriberID])
+			}
+		}
+	}
+
+	return recipients
+}
+
+// send sends every message to its recipients in order. The senders of all
+// recipients are locked in the order of their subscriber IDs while sending,
+// so a batch is not interleaved with other messages and concurrent batches
+// can not lock each other out.
+func send(msgs []data.Message, recipients [][]*sender) {
+	locked := map[*sender]bool{}
+	var senders []*sender
+	for _, rs := range recipients {
+		for _, r := range rs {
+			if !locked[r] {
+				locked[r] = true
+				senders = append(senders, r)
+			}
+		}
+	}
+	sort.Slice(senders, func(i, j int) bool {
+		return senders[i].subscriberID < senders[j].subscriberID
+	})
+
+	for _, s := range senders {
+		s.mu.Lock()
+	}
+	for i, msg := range msgs {
+		for _, r := range recipients[i] {
+			r.send(msg)
+		}
+	}
+	for _, s := range senders {
+		s.mu.Unlock()
+	}
+}
+
+// repeat returns a slice with the recipients for each of n messages.
+func repeat(recipients []*sender, n int) [][]*sender {
+	repeated := make([][]*sender, n)
+	for i := range repeated {
+		repeated[i] = recipients
+	}
+
+	return repeated
+}
+
+// Resume adds the committed positions of a durable subscription to the topics
+// of the request, they take precedence over the requested timestamps.
+func (b *brokerService) Resume(ctx context.Context, req models.SubscribeRequest) (models.SubscribeRequest, error) {
+	if req.Subscription == "" {
+		return req, nil
+	}
+
+	offsets, err := b.repo.GetOffsets(ctx, req.Subscription)
+	if err != nil {
+		return req, err
+	}
+
+	topics := make(map[string]int64, len(req.Topics)+len(offsets))
+	for topic, timestamp := range req.Topics {
+		topics[topic] = timestamp
+	}
+	for topic, timestamp := range offsets {
+		topics[topic] = timestamp
+	}
+	req.Topics = topics
+
+	return req, nil
+}
+
+// Subscribe replays stored messages until ctx is done, durable
+// subscriptions must be resumed with Resume first.
+func (b *brokerService) Subscribe(ctx context.Context, req models.SubscribeRequest) (<-chan data.Message, string, error) {
 	// Generate subscriber ID
 	subscriberID := uuid.NewString()
 
-	slog.Debug("Subscribing to topics", "subscriber", subscriberID, "topics", topics)
+	slog.Debug("Subscribing to topics", "subscriber", subscriberID, "topics", req.Topics, "group", req.Group, "subscription", req.Subscription, "ack", req.Ack)
+
+	// Get stored topics to replay wildcard subscriptions
+	var storedTopics []string
+	for topic := range req.Topics {
+		if IsWildcard(topic) {
+			topics, err := b.repo.GetTopics()
+			if err != nil {
+				return nil, subscriberID, err
+			}
+			storedTopics = topics
+			break
+		}
+	}
+
+	// Create subscriber channel
+	subscriber := make(chan data.Message, 10)
+
+	// Groups created by this subscriber, which replays their history once
+	replays := map[string]*group{} // map[topic_name]*group
+
+	// Unacked messages left by former members of the groups
+	var orphans []data.Message
 
 	b.mu.Lock()
-	for topic := range topics {
+	b.subscribers[subscriberID] = req
+	b.senders[subscriberID] = &sender{
+		subscriberID: subscriberID,
+		subscriber:   subscriber,
+		done:         make(chan struct{}),
+	}
+	if req.Ack {
+		f := &inflight{
+			consumer:   deliveryConsumer(subscriberID, req),
+			subscriber: subscriber,
+			messages:   map[string]inflightMessage{},
+			done:       make(chan struct{}),
+		}
+		b.inflight[subscriberID] = f
+		go b.redeliveryJob(f)
+	}
+	for topic := range req.Topics {
 		// Create topic if it does not exist
 		if _, ok := b.topics[topic]; !ok {
 			b.topics[topic] = map[string]chan data.Message{}
 		}
+		if IsWildcard(topic) {
+			b.wildcards[topic] = true
+		}
+
+		// Create group if it does not exist
+		if req.Group == "" {
+			continue
+		}
+		if _, ok := b.groups[topic]; !ok {
+			b.groups[topic] = map[string]*group{}
+		}
+		if _, ok := b.groups[topic][req.Group]; !ok {
+			groupCtx, cancel := context.WithCancel(context.Background())
+			b.groups[topic][req.Group] = &group{
+				channels: map[string]chan data.Message{},
+				ctx:      groupCtx,
+				cancel:   cancel,
+			}
+			replays[topic] = b.groups[topic][req.Group]
+		}
 	}
 	b.mu.Unlock()
 
-	// Create subscriber channel
-	subscriber := make(chan data.Message, 10)
+	for topic, timestamp := range req.Topics {
+		// The history of a group is replayed once to its members in round-robin
+		// order, members joining later only receive new messages
+		replayCtx, g := ctx, replays[topic]
+		if g != nil {
+			replayCtx = g.ctx
+		}
 
-	for topic, timestamp := range topics {
 		// Get all messages published after last timestamp
-		msgChan := b.repo.GetMessages(topic, timestamp)
+		var msgChans []<-chan []data.Message
+		if req.Group == "" || g != nil {
+			if !IsWildcard(topic) {
+				msgChans = append(msgChans, b.repo.GetMessages(replayCtx, topic, timestamp, req.Filters...))
+			}
+			for _, name := range storedTopics {
+				// Topics subscribed by name are replayed on their own
+				if _, ok := req.Topics[name]; ok || !MatchTopic(topic, name) {
+					continue
+				}
+				msgChans = append(msgChans, b.repo.GetMessages(replayCtx, name, timestamp, req.Filters...))
+			}
+		}
 
-		// Add subscriber to topic
+		// Add subscriber to topic or to its group
 		b.mu.Lock()
-		b.topics[topic][subscriberID] = subscriber
+		if req.Group == "" {
+			b.topics[topic][subscriberID] = subscriber
+		} else {
+			b.groups[topic][req.Group].join(subscriberID, subscriber)
+			slog.Debug("Subscriber joined group", "subscriber", subscriberID, "topic", topic, "group", req.Group, "members", len(b.groups[topic][req.Group].members))
+			orphans = append(orphans, b.adoptOrphans(topic, req)...)
+		}
 		b.mu.Unlock()
 
-		go func() {
-			for {
-				messages, ok := <-msgChan
-				if !ok {
-					break
-				}
+		for _, msgChan := range msgChans {
+			if g != nil {
+				go b.replayToGroup(g, req.Filters, msgChan)
+				continue
+			}
+
+			go func(msgChan <-chan []data.Message) {
+				for {
+					messages, ok := <-msgChan
+					if !ok {
+						break
+					}
 
-				for _, msg := range messages {
-					subscriber <- msg
+					for _, msg := range messages {
+						if !data.Match(req.Filters, msg) {
+							continue
+						}
+
+						select {
+						case subscriber <- msg:
+						case <-ctx.Done():
+							return
+						}
+					}
 				}
-			}
-		}()
+			}(msgChan)
+		}
+	}
+
+	if len(orphans) > 0 {
+		slog.Info("Redelivering unacked messages of former group members", "subscriber", subscriberID, "group", req.Group, "messages", len(orphans))
+		b.mu.RLock()
+		s := b.senders[subscriberID]
+		b.mu.RUnlock()
+
+		go send(orphans, repeat([]*sender{s}, len(orphans)))
 	}
 
 	return subscriber, subscriberID, nil
 }
 
-func (b *brokerService) Unsubscribe(subscriberID string, topics map[string]int64) {
-	slog.Debug("Unsubscribing from topics", "subscriber", subscriberID, "topics", topics)
+// adoptOrphans returns the orphaned messages of the group on the topic that
+// match the filters of the joining member, the caller must hold mu.
+func (b *brokerService) adoptOrphans(topic string, req models.SubscribeRequest) []data.Message {
+	orphans := b.orphans[topic][req.Group]
+	if len(orphans) == 0 {
+		return nil
+	}
+
+	var adopted, kept []data.Message
+	for _, msg := range orphans {
+		if data.Match(req.Filters, msg) {
+			adopted = append(adopted, msg)
+		} else {
+			kept = append(kept, msg)
+		}
+	}
+
+	if len(kept) > 0 {
+		b.orphans[topic][req.Group] = kept
+	} else {
+		delete(b.orphans[topic], req.Group)
+		if len(b.orphans[topic]) == 0 {
+			delete(b.orphans, topic)
+		}
+	}
+
+	return adopted
+}
+
+// replayToGroup sends stored messages to the members of the group in
+// round-robin order, until the last member leaves.
+func (b *brokerService) replayToGroup(g *group, filters []data.Filter, msgChan <-chan []data.Message) {
+	for {
+		messages, ok := <-msgChan
+		if !ok {
+			break
+		}
+
+		for _, msg := range messages {
+			if !data.Match(filters, msg) {
+				continue
+			}
+
+			b.mu.RLock()
+			accepts := func(subscriberID string) bool {
+				return data.Match(b.subscribers[subscriberID].Filters, msg)
+			}
+			subscriberID, ok := g.pick(accepts)
+			s := b.senders[subscriberID]
+			b.mu.RUnlock()
+
+			select {
+			case <-g.ctx.Done():
+				return
+			default:
+			}
+			if !ok {
+				continue
+			}
+
+			s.mu.Lock()
+			s.send(msg)
+			s.mu.Unlock()
+		}
+	}
+}
 
+// Unsubscribe removes the subscriber. Messages an acknowledging member of
+// a group received but did not ack are handed back to the group.
+func (b *brokerService) Unsubscribe(subscriberID string) {
 	b.mu.Lock()
-	for topic := range topics {
+
+	req, ok := b.subscribers[subscriberID]
+	if !ok {
+		b.mu.Unlock()
+		return
+	}
+	delete(b.subscribers, subscriberID)
+
+	if s, ok := b.senders[subscriberID]; ok {
+		close(s.done)
+		delete(b.senders, subscriberID)
+	}
+
+	var unacked []data.Message
+	var consumer string
+	if f, ok := b.inflight[subscriberID]; ok {
+		close(f.done)
+		delete(b.inflight, subscriberID)
+		unacked = f.unacked()
+		consumer = f.consumer
+	}
+
+	slog.Debug("Unsubscribing from topics", "subscriber", subscriberID, "topics", req.Topics, "group", req.Group)
+
+	for topic := range req.Topics {
 		if _, ok := b.topics[topic]; ok {
 			delete(b.topics[topic], subscriberID)
 		}
+
+		// Remove subscriber from group, remaining members take over its share
+		if g, ok := b.groups[topic][req.Group]; ok && req.Group != "" {
+			g.leave(subscriberID)
+			slog.Debug("Subscriber left group", "subscriber", subscriberID, "topic", topic, "group", req.Group, "members", len(g.members))
+			if len(g.members) == 0 {
+				g.cancel()
+				delete(b.groups[topic], req.Group)
+			}
+		}
+
+		// Forget wildcard patterns nobody subscribes to anymore
+		if b.wildcards[topic] && len(b.topics[topic]) == 0 && len(b.groups[topic]) == 0 {
+			delete(b.topics, topic)
+			delete(b.groups, topic)
+			delete(b.wildcards, topic)
+		}
+	}
+
+	var msgs []data.Message
+	var recipients [][]*sender
+	if req.Group != "" && len(unacked) > 0 {
+		msgs, recipients = b.handBack(req, unacked)
 	}
 	b.mu.Unlock()
+
+	// Delivery attempts of subscribers without group or subscription end with them
+	if consumer == subscriberID && len(unacked) > 0 {
+		ids := make([]string, len(unacked))
+		for i, msg := range unacked {
+			ids[i] = msg.ID
+		}
+		b.forgetDeliveries(consumer, ids)
+	}
+
+	if len(msgs) > 0 {
+		slog.Info("Handing unacked messages back to group", "subscriber", subscriberID, "group", req.Group, "messages", len(msgs))
+		send(msgs, recipients)
+	}
+}
+
+// handBack picks a remaining member of the group for every unacked message of a
+// member that left, and keeps the messages no member accepts for the next member
+// to join. It returns the picked messages with their recipients, the caller must hold mu.
+func (b *brokerService) handBack(req models.SubscribeRequest, unacked []data.Message) ([]data.Message, [][]*sender) {
+	var msgs []data.Message
+	var recipients [][]*sender
+	for _, msg := range unacked {
+		// The group of the first subscribed topic or pattern matching the message
+		var key string
+		for topic := range req.Topics {
+			if topic == msg.Topic || (IsWildcard(topic) && MatchTopic(topic, msg.Topic)) {
+				if key == "" || topic < key {
+					key = topic
+				}
+			}
+		}
+		if key == "" {
+			continue
+		}
+
+		if g, ok := b.groups[key][req.Group]; ok {
+			accepts := func(subscriberID string) bool {
+				return data.Match(b.subscribers[subscriberID].Filters, msg)
+			}
+			if subscriberID, ok := g.pick(accepts); ok {
+				msgs = append(msgs, msg)
+				recipients = append(recipients, []*sender{b.senders[subscriberID]})
+				continue
+			}
+		}
+
+		if b.orphans[key] == nil {
+			b.orphans[key] = map[string][]data.Message{}
+		}
+		orphans := append(b.orphans[key][req.Group], msg)
+		if len(orphans) > MAX_ORPHANED_MESSAGES {
+			slog.Warn("Dropping unacked messages of group without members", "topic", key, "group", req.Group, "messages", len(orphans)-MAX_ORPHANED_MESSAGES)
+			orphans = orphans[len(orphans)-MAX_ORPHANED_MESSAGES:]
+		}
+		b.orphans[key][req.Group] = orphans
+	}
+
+	return msgs, recipients
+}
+
+// unacked returns the messages sent to the subscriber that it did not ack,
+// including the ones still waiting in its channel, in timestamp order.
+// The subscriber must have left.
+func (f *inflight) unacked() []data.Message {
+	f.mu.Lock()
+	msgs := make([]data.Message, 0, len(f.messages))
+	seen := make(map[string]bool, len(f.messages))
+	for id, m := range f.messages {
+		msgs = append(msgs, m.message)
+		seen[id] = true
+	}
+	f.mu.Unlock()
+
+	for {
+		select {
+		case msg := <-f.subscriber:
+			if !seen[msg.ID] {
+				msgs = append(msgs, msg)
+				seen[msg.ID] = true
+			}
+			continue
+		default:
+		}
+		break
+	}
+
+	sort.Slice(msgs, func(i, j int) bool {
+		return msgs[i].Timestamp < msgs[j].Timestamp
+	})
+
+	return msgs
+}
+
+func (b *brokerService) Commit(ctx context.Context, offset data.Offset) error {
+	slog.Debug("Committing offset", "subscription", offset.Subscription, "topic", offset.Topic, "timestamp", offset.Timestamp)
+
+	return b.repo.CommitOffset(ctx, &offset)
+}
+
+// Deliver counts an attempt to deliver the message to an acknowledging subscriber.
+// Attempts are persisted per group or durable subscription, so they survive
+// reconnects and restarts. It returns false if the message used up its attempts
+// and was moved to the dead-letter topic instead of being sent.
+func (b *brokerService) Deliver(ctx context.Context, subscriberID string, msg data.Message) bool {
+	b.mu.RLock()
+	f, ok := b.inflight[subscriberID]
+	b.mu.RUnlock()
+	if !ok {
+		return true
+	}
+
+	attempts, err := b.repo.IncrementDeliveries(ctx, f.consumer, msg.ID)
+	if err != nil {
+		slog.Error("Failed to count delivery attempt", "message", msg.ID, "consumer", f.consumer, "error", err.Error())
+
+		// Count the attempts of this connection only
+		f.mu.Lock()
+		attempts = f.messages[msg.ID].deliveries + 1
+		f.mu.Unlock()
+	}
+
+	if max := b.maxDeliveryAttempts(msg.Topic); max > 0 && attempts > max {
+		f.mu.Lock()
+		delete(f.messages, msg.ID)
+		f.mu.Unlock()
+
+		b.deadLetter(msg, attempts-1)
+		b.forgetDeliveries(f.consumer, []string{msg.ID})
+		return false
+	}
+
+	f.mu.Lock()
+	m := f.messages[msg.ID]
+	m.message = msg
+	m.deliveries = attempts
+	m.deadline = time.Now().Add(b.visibilityTimeout)
+	f.messages[msg.ID] = m
+	f.mu.Unlock()
+
+	return true
+}
+
+// forgetDeliveries deletes the persisted delivery attempts of acked or dead-lettered messages.
+func (b *brokerService) forgetDeliveries(consumer string, ids []string) {
+	if err := b.repo.DeleteDeliveries(context.Background(), consumer, ids); err != nil {
+		slog.Error("Failed to delete delivery attempts", "consumer", consumer, "error", err.Error())
+	}
+}
+
+// deliveryConsumer returns the key delivery attempts are counted under: the group
+// or durable subscription of the subscriber, or the subscriber itself.
+func deliveryConsumer(subscriberID string, req models.SubscribeRequest) string {
+	if req.Group != "" {
+		return "group/" + req.Group
+	}
+	if req.Subscription != "" {
+		return "subscription/" + req.Subscription
+	}
+
+	return subscriberID
+}
+
+func (b *brokerService) Ack(subscriberID string, ids []string) {
+	b.mu.RLock()
+	f, ok := b.inflight[subscriberID]
+	b.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	slog.Debug("Acknowledging messages", "subscriber", subscriberID, "messages", ids)
+
+	f.mu.Lock()
+	for _, id := range ids {
+		delete(f.messages, id)
+	}
+	f.mu.Unlock()
+
+	b.forgetDeliveries(f.consumer, ids)
+}
+
+func (b *brokerService) Nack(subscriberID string, ids []string) {
+	b.mu.RLock()
+	f, ok := b.inflight[subscriberID]
+	b.mu.RUnlock()
+	if !ok {
+		return
+	}
+
+	slog.Debug("Rejecting messages", "subscriber", subscriberID, "messages", ids)
+
+	b.redeliver(f, ids)
+}
+
+func (b *brokerService) DeadLetters() <-chan data.Message {
+	return b.deadLetters
+}
+
+// Deduplicate returns the ID of the message published with the
+// idempotency key within the deduplication window, if any.
+func (b *brokerService) Deduplicate(idempotencyKey string) (string, bool) {
+	if b.deduplicationWindow <= 0 {
+		return "", false
+	}
+
+	timestamp := time.Now().Add(-b.deduplicationWindow).UnixMicro()
+	id, err := b.repo.GetMessageID(idempotencyKey, timestamp)
+	if err != nil {
+		slog.Error("Failed to get message by idempotency key", "key", idempotencyKey, "error", err.Error())
+		return "", false
+	}
+
+	return id, id != ""
+}
+
+func (b *brokerService) redeliveryJob(f *inflight) {
+	ticker := time.NewTicker(REDELIVERY_INTERVAL)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-f.done:
+			return
+		}
+
+		// Collect messages that were not acked in time
+		var ids []string
+		f.mu.Lock()
+		now := time.Now()
+		for id, m := range f.messages {
+			if m.deadline.Before(now) {
+				ids = append(ids, id)
+			}
+		}
+		f.mu.Unlock()
+
+		b.redeliver(f, ids)
+	}
+}
+
+// redeliver sends in-flight messages to the subscriber again, or moves
+// them to the dead-letter topic once they used up their delivery attempts.
+func (b *brokerService) redeliver(f *inflight, ids []string) {
+	var retry []data.Message
+	var dead []inflightMessage
+
+	f.mu.Lock()
+	for _, id := range ids {
+		m, ok := f.messages[id]
+		if !ok {
+			continue
+		}
+
+		if max := b.maxDeliveryAttempts(m.message.Topic); max > 0 && m.deliveries >= max {
+			delete(f.messages, id)
+			dead = append(dead, m)
+			continue
+		}
+
+		// Push back the deadline, so it is not redelivered again before being sent
+		m.deadline = time.Now().Add(b.visibilityTimeout)
+		f.messages[id] = m
+		retry = append(retry, m.message)
+	}
+	f.mu.Unlock()
+
+	for _, m := range dead {
+		b.deadLetter(m.message, m.deliveries)
+		b.forgetDeliveries(f.consumer, []string{m.message.ID})
+	}
+
+	for _, msg := range retry {
+		slog.Warn("Redelivering unacked message", "message", msg.ID, "topic", msg.Topic)
+		select {
+		case f.subscriber <- msg:
+		case <-f.done:
+			return
+		}
+	}
+}
+
+func (b *brokerService) maxDeliveryAttempts(topic string) int {
+	if max, ok := b.topicMaxAttempts[topic]; ok {
+		return max
+	}
+
+	return b.maxAttempts
+}
+
+func (b *brokerService) deadLetter(msg data.Message, failures int) {
+	// Do not chain dead-letter topics
+	if strings.HasSuffix(msg.Topic, DEAD_LETTER_SUFFIX) {
+		slog.Warn("Dropping message from dead-letter topic", "message", msg.ID, "topic", msg.Topic, "failures", failures)
+		return
+	}
+
+	headers := make(map[string]string, len(msg.Headers)+3)
+	for k, v := range msg.Headers {
+		headers[k] = v
+	}
+	headers["original_id"] = msg.ID
+	headers["original_topic"] = msg.Topic
+	headers["failure_count"] = strconv.Itoa(failures)
+
+	slog.Warn("Moving message to dead-letter topic", "message", msg.ID, "topic", msg.Topic, "failures", failures)
+
+	b.deadLetters <- data.Message{
+		Topic:   msg.Topic + DEAD_LETTER_SUFFIX,
+		Body:    msg.Body,
+		Headers: headers,
+	}
 }
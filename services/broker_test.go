@@ -0,0 +1,284 @@
+package services
+
+import (
+	"context"
+	"geo-distributed-message-broker/config"
+	"geo-distributed-message-broker/data"
+	"geo-distributed-message-broker/models"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func newTestBrokerService(t *testing.T, cfg config.Config) *brokerService {
+	t.Helper()
+
+	cfg.Database = filepath.Join(t.TempDir(), "broker.db")
+	db, err := data.NewDB(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { data.CloseDB(db) })
+
+	return NewBrokerService(cfg, data.NewRepository(db)).(*brokerService)
+}
+
+func subscribeToGroup(t *testing.T, b *brokerService) (<-chan data.Message, string) {
+	t.Helper()
+
+	msgs, subscriberID, err := b.Subscribe(context.Background(), models.SubscribeRequest{
+		Topics: map[string]int64{"orders": time.Now().UnixMicro()},
+		Group:  "workers",
+		Ack:    true,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msgs, subscriberID
+}
+
+// receive returns the message the subscriber received and marks it delivered.
+func receive(t *testing.T, b *brokerService, subscriberID string, msgs <-chan data.Message) data.Message {
+	t.Helper()
+
+	select {
+	case msg := <-msgs:
+		b.Deliver(context.Background(), subscriberID, msg)
+		return msg
+	case <-time.After(time.Second):
+		t.Fatal("no message received")
+	}
+
+	return data.Message{}
+}
+
+func TestUnsubscribeHandsBackUnackedMessages(t *testing.T) {
+	b := newTestBrokerService(t, config.Config{VisibilityTimeout: time.Minute})
+
+	first, firstID := subscribeToGroup(t, b)
+	second, secondID := subscribeToGroup(t, b)
+
+	id, err := b.Publish(context.Background(), data.Message{Topic: "orders", Body: []byte("order")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The member holding the unacked message disconnects
+	var msg data.Message
+	remaining, remainingID := second, secondID
+	select {
+	case msg = <-first:
+		b.Deliver(context.Background(), firstID, msg)
+		b.Unsubscribe(firstID)
+	case msg = <-second:
+		b.Deliver(context.Background(), secondID, msg)
+		b.Unsubscribe(secondID)
+		remaining, remainingID = first, firstID
+	case <-time.After(time.Second):
+		t.Fatal("no member received the message")
+	}
+	if msg.ID != id {
+		t.Fatalf("message ID = %s, want %s", msg.ID, id)
+	}
+
+	if got := receive(t, b, remainingID, remaining); got.ID != id {
+		t.Errorf("handed back message ID = %s, want %s", got.ID, id)
+	}
+}
+
+func TestUnsubscribeKeepsUnackedMessagesForNextMember(t *testing.T) {
+	b := newTestBrokerService(t, config.Config{VisibilityTimeout: time.Minute})
+
+	msgs, subscriberID := subscribeToGroup(t, b)
+
+	id, err := b.Publish(context.Background(), data.Message{Topic: "orders", Body: []byte("order")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receive(t, b, subscriberID, msgs)
+
+	// The last member disconnects, the next one to join gets its unacked message
+	b.Unsubscribe(subscriberID)
+	msgs, subscriberID = subscribeToGroup(t, b)
+
+	if got := receive(t, b, subscriberID, msgs); got.ID != id {
+		t.Errorf("handed back message ID = %s, want %s", got.ID, id)
+	}
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	if len(b.orphans) != 0 {
+		t.Errorf("orphans = %v, want none", b.orphans)
+	}
+}
+
+func TestDeliveryAttemptsSurviveReconnects(t *testing.T) {
+	b := newTestBrokerService(t, config.Config{VisibilityTimeout: time.Minute, MaxDeliveryAttempts: 2})
+	msg := data.Message{ID: "m1", Topic: "orders", Timestamp: 1}
+	req := models.SubscribeRequest{Topics: map[string]int64{"orders": 0}, Subscription: "billing", Ack: true}
+
+	// The consumer crashes on the message on every connection
+	for attempt := 1; attempt <= 3; attempt++ {
+		_, subscriberID, err := b.Subscribe(context.Background(), req)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		want := attempt <= 2
+		if got := b.Deliver(context.Background(), subscriberID, msg); got != want {
+			t.Fatalf("attempt %d: Deliver() = %v, want %v", attempt, got, want)
+		}
+		b.Unsubscribe(subscriberID)
+	}
+
+	select {
+	case dead := <-b.DeadLetters():
+		if dead.Topic != "orders"+DEAD_LETTER_SUFFIX || dead.Headers["original_id"] != msg.ID || dead.Headers["failure_count"] != "2" {
+			t.Errorf("dead letter = %+v, want message %s after 2 failures", dead, msg.ID)
+		}
+	default:
+		t.Fatal("message was not dead-lettered")
+	}
+}
+
+func TestStoreDoesNotSendToSubscribers(t *testing.T) {
+	b := newTestBrokerService(t, config.Config{CompactedTopics: []string{"prices"}})
+
+	now := time.Now().UnixMicro()
+	msgs, _, err := b.Subscribe(context.Background(), models.SubscribeRequest{Topics: map[string]int64{"prices": now - 10}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	newer := data.Message{ID: "newer", Topic: "prices", Key: "btc", Timestamp: now}
+	if _, err := b.Publish(context.Background(), newer); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-msgs:
+	case <-time.After(time.Second):
+		t.Fatal("published message was not received")
+	}
+
+	// A message the node missed, older than the one it has with the same key
+	older := data.Message{ID: "older", Topic: "prices", Key: "btc", Timestamp: now - 1}
+	if err := b.Store(context.Background(), []data.Message{older}); err != nil {
+		t.Fatal(err)
+	}
+
+	// The published message may also come from the replay of the subscription
+	timeout := time.After(100 * time.Millisecond)
+	for done := false; !done; {
+		select {
+		case msg := <-msgs:
+			if msg.ID == older.ID {
+				t.Errorf("subscriber received stored message %s", msg.ID)
+			}
+		case <-timeout:
+			done = true
+		}
+	}
+
+	existing, err := b.repo.GetExistingIDs([]string{older.ID, newer.ID})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if existing[older.ID] || !existing[newer.ID] {
+		t.Errorf("stored messages = %v, want only %s", existing, newer.ID)
+	}
+}
+
+func TestResume(t *testing.T) {
+	b := newTestBrokerService(t, config.Config{})
+
+	offsets := []data.Offset{
+		{Subscription: "billing", Topic: "orders", Timestamp: 10},
+		{Subscription: "billing", Topic: "orders", Timestamp: 20},
+		{Subscription: "billing", Topic: "payments", Timestamp: 30},
+		{Subscription: "shipping", Topic: "orders", Timestamp: 40},
+	}
+	for _, offset := range offsets {
+		if err := b.Commit(context.Background(), offset); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		req  models.SubscribeRequest
+		want map[string]int64
+	}{
+		{
+			name: "without subscription",
+			req:  models.SubscribeRequest{Topics: map[string]int64{"orders": 5}},
+			want: map[string]int64{"orders": 5},
+		},
+		{
+			name: "latest committed offsets",
+			req:  models.SubscribeRequest{Topics: map[string]int64{"orders": 5}, Subscription: "billing"},
+			want: map[string]int64{"orders": 20, "payments": 30},
+		},
+		{
+			name: "topic without committed offset",
+			req:  models.SubscribeRequest{Topics: map[string]int64{"refunds": 5}, Subscription: "shipping"},
+			want: map[string]int64{"refunds": 5, "orders": 40},
+		},
+		{
+			name: "new subscription",
+			req:  models.SubscribeRequest{Topics: map[string]int64{"orders": 5}, Subscription: "audit"},
+			want: map[string]int64{"orders": 5},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req, err := b.Resume(context.Background(), tt.req)
+			if err != nil {
+				t.Fatalf("Resume() error = %v, want nil", err)
+			}
+			if !reflect.DeepEqual(req.Topics, tt.want) {
+				t.Errorf("Resume() topics = %v, want %v", req.Topics, tt.want)
+			}
+		})
+	}
+}
+
+func TestReplayKeepsHeaders(t *testing.T) {
+	b := newTestBrokerService(t, config.Config{})
+
+	tests := []struct {
+		id      string
+		headers map[string]string
+	}{
+		{id: "m1", headers: nil},
+		{id: "m2", headers: map[string]string{"trace_id": "abc"}},
+		{id: "m3", headers: map[string]string{"trace_id": "def", "content-type": "application/json"}},
+	}
+	for i, tt := range tests {
+		msg := data.Message{ID: tt.id, Topic: "orders", Timestamp: int64(i + 1), Headers: tt.headers}
+		if _, err := b.Publish(context.Background(), msg); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	msgs, _, err := b.Subscribe(context.Background(), models.SubscribeRequest{Topics: map[string]int64{"orders": 0}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range tests {
+		select {
+		case msg := <-msgs:
+			if msg.ID != tt.id {
+				t.Fatalf("replayed message = %s, want %s", msg.ID, tt.id)
+			}
+			if len(msg.Headers) != len(tt.headers) || (len(tt.headers) > 0 && !reflect.DeepEqual(msg.Headers, tt.headers)) {
+				t.Errorf("message %s headers = %v, want %v", tt.id, msg.Headers, tt.headers)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("message %s was not replayed", tt.id)
+		}
+	}
+}
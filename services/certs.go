@@ -0,0 +1,228 @@
+package services
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"geo-distributed-message-broker/config"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// Certificates holds a CA and the server and client key pairs of a node,
+// reloading them when their files change, so short-lived certificates can be
+// rotated without a restart. New connections use the reloaded certificates.
+type Certificates struct {
+	caPath     string // empty without a CA
+	serverCert string
+	serverKey  string
+	clientCert string // empty without a client key pair
+	clientKey  string
+	interval   time.Duration
+
+	mu       sync.RWMutex // protects the fields below
+	ca       *x509.CertPool
+	server   *tls.Certificate
+	client   *tls.Certificate
+	modTimes map[string]time.Time // map[path]modification_time
+}
+
+// NewNodeCertificates returns the certificates of the node service,
+// used for mutual TLS between nodes.
+func NewNodeCertificates(cfg config.Config) (*Certificates, error) {
+	slog.Info("Loading node certificates 🔏", "ca", cfg.CACert, "server", cfg.ServerCert, "client", cfg.ClientCert)
+
+	return newCertificates(cfg.CACert, cfg.ServerCert, cfg.ServerKey, cfg.ClientCert, cfg.ClientKey, cfg.CertReloadInterval)
+}
+
+// NewBrokerCertificates returns the certificates of the broker service,
+// its CA verifies the certificates of clients.
+func NewBrokerCertificates(cfg config.Config) (*Certificates, error) {
+	slog.Info("Loading broker certificates 🔏", "ca", cfg.BrokerClientCA, "server", cfg.BrokerCert)
+
+	return newCertificates(cfg.BrokerClientCA, cfg.BrokerCert, cfg.BrokerKey, "", "", cfg.CertReloadInterval)
+}
+
+func newCertificates(caPath string, serverCert string, serverKey string, clientCert string, clientKey string, interval time.Duration) (*Certificates, error) {
+	c := &Certificates{
+		caPath:     caPath,
+		serverCert: serverCert,
+		serverKey:  serverKey,
+		clientCert: clientCert,
+		clientKey:  clientKey,
+		interval:   interval,
+	}
+
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	if c.interval > 0 {
+		time.AfterFunc(c.interval, c.reloadJob)
+	}
+
+	return c, nil
+}
+
+// ServerConfig returns a TLS config presenting the current server certificate
+// and verifying client certificates against the current CA.
+func (c *Certificates) ServerConfig(clientAuth tls.ClientAuthType) *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			conf := &tls.Config{
+				Certificates: []tls.Certificate{*c.server},
+				MinVersion:   tls.VersionTLS12,
+				NextProtos:   []string{"h2"},
+			}
+			if c.ca != nil {
+				conf.ClientCAs = c.ca
+				conf.ClientAuth = clientAuth
+			}
+
+			return conf, nil
+		},
+	}
+}
+
+// ClientConfig returns a TLS config presenting the current client certificate
+// and verifying servers against the current CA.
+func (c *Certificates) ClientConfig() *tls.Config {
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetClientCertificate: func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+			c.mu.RLock()
+			defer c.mu.RUnlock()
+
+			if c.client == nil {
+				return &tls.Certificate{}, nil
+			}
+			return c.client, nil
+		},
+		// The CA can change after the config is created, so the server
+		// certificate is verified by hand instead of with RootCAs
+		InsecureSkipVerify: true,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			if len(cs.PeerCertificates) == 0 {
+				return errors.New("server presented no certificate")
+			}
+
+			c.mu.RLock()
+			roots := c.ca
+			c.mu.RUnlock()
+
+			intermediates := x509.NewCertPool()
+			for _, cert := range cs.PeerCertificates[1:] {
+				intermediates.AddCert(cert)
+			}
+
+			_, err := cs.PeerCertificates[0].Verify(x509.VerifyOptions{
+				DNSName:       cs.ServerName,
+				Roots:         roots,
+				Intermediates: intermediates,
+			})
+			return err
+		},
+	}
+}
+
+func (c *Certificates) load() error {
+	modTimes := make(map[string]time.Time)
+	for _, path := range c.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		modTimes[path] = info.ModTime()
+	}
+
+	var ca *x509.CertPool
+	if c.caPath != "" {
+		caPem, err := os.ReadFile(c.caPath)
+		if err != nil {
+			return err
+		}
+
+		ca = x509.NewCertPool()
+		if !ca.AppendCertsFromPEM(caPem) {
+			return fmt.Errorf("failed to append ca's cert %s", c.caPath)
+		}
+	}
+
+	server, err := tls.LoadX509KeyPair(c.serverCert, c.serverKey)
+	if err != nil {
+		return err
+	}
+
+	var client *tls.Certificate
+	if c.clientCert != "" {
+		cert, err := tls.LoadX509KeyPair(c.clientCert, c.clientKey)
+		if err != nil {
+			return err
+		}
+		client = &cert
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ca = ca
+	c.server = &server
+	c.client = client
+	c.modTimes = modTimes
+
+	return nil
+}
+
+// changed reports whether any certificate file was modified since the last load.
+func (c *Certificates) changed() bool {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+
+	for _, path := range c.paths() {
+		info, err := os.Stat(path)
+		if err != nil {
+			// Files can be missing for a moment while they are replaced
+			continue
+		}
+		if !info.ModTime().Equal(c.modTimes[path]) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (c *Certificates) paths() []string {
+	paths := []string{c.serverCert, c.serverKey}
+	if c.caPath != "" {
+		paths = append(paths, c.caPath)
+	}
+	if c.clientCert != "" {
+		paths = append(paths, c.clientCert, c.clientKey)
+	}
+
+	return paths
+}
+
+// reloadJob reloads the certificates if their files changed, keeping the
+// current ones if the new files are invalid, e.g. only partially written.
+func (c *Certificates) reloadJob() {
+	defer time.AfterFunc(c.interval, c.reloadJob)
+
+	if !c.changed() {
+		return
+	}
+
+	if err := c.load(); err != nil {
+		slog.Error("Failed to reload certificates", "server", c.serverCert, "error", err.Error())
+		return
+	}
+
+	slog.Info("Reloaded certificates 🔏", "server", c.serverCert)
+}
@@ -0,0 +1,23 @@
+package services
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// clock hands out increasing message timestamps.
+type clock struct {
+	last atomic.Int64 // last reserved timestamp
+}
+
+// reserve returns the first of n consecutive timestamps later than after and
+// than the ones reserved before, so rounds started by this node do not conflict.
+func (c *clock) reserve(after int64, n int) int64 {
+	for {
+		last := c.last.Load()
+		timestamp := max(time.Now().UnixMicro(), last+1, after+1)
+		if c.last.CompareAndSwap(last, timestamp+int64(n)-1) {
+			return timestamp
+		}
+	}
+}
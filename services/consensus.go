@@ -1,11 +1,14 @@
 package services
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"geo-distributed-message-broker/config"
 	"geo-distributed-message-broker/data"
 	"geo-distributed-message-broker/models"
 	"log/slog"
+	"sort"
 	"sync"
 	"time"
 
@@ -13,17 +16,74 @@ import (
 )
 
 type ConsensusService interface {
-	Publish(msg data.Message) (string, error)
-	Propose(req models.ProposeRequest) (models.ProposeResponse, error)
-	Stable(req models.StableRequest) error
+	Publish(ctx context.Context, msg data.Message) (string, error)
+	Propose(ctx context.Context, req models.ProposeRequest) (models.ProposeResponse, error)
+	Stable(ctx context.Context, req models.StableRequest) error
+	PublishBatch(ctx context.Context, msgs []data.Message) ([]string, error)
+	ProposeBatch(ctx context.Context, req models.ProposeBatchRequest) (models.ProposeBatchResponse, error)
+	StableBatch(ctx context.Context, req models.StableBatchRequest) error
+	Abort(ctx context.Context, req models.AbortRequest) error
+	Digest(ctx context.Context, req models.DigestRequest) (models.DigestResponse, error)
+	Pull(ctx context.Context, req models.PullRequest) (models.PullResponse, error)
+	AddNode(ctx context.Context, host string, region string) error
+	RemoveNode(ctx context.Context, host string) error
+	GetNodes() (models.Membership, map[string]models.NodeHealth, error)
+	GetTopology() ([]models.Endpoint, error)
+	Join(ctx context.Context, req models.Membership) error
+	ProposeMembership(ctx context.Context, req models.Membership) error
+	UpdateMembership(ctx context.Context, req models.Membership) error
 }
 
-func NewConsensusService(cfg config.Config, broker BrokerService) ConsensusService {
-	slog.Info("Creating new consensus service 🏛️")
+func NewConsensusService(cfg config.Config, broker BrokerService, repo data.Repository, retention RetentionService, certs *Certificates) ConsensusService {
+	// A membership changed at runtime overrides NODES
+	membership, err := loadMembership(cfg.MembershipFile)
+	if err != nil {
+		slog.Error("Failed to load membership, using NODES", "path", cfg.MembershipFile, "error", err.Error())
+	}
+	if membership.Version == 0 {
+		membership = models.Membership{
+			Nodes: cfg.Nodes,
+		}
+	}
+
+	// Every node must know the same regions to agree on quorums, so they are part of the membership
+	if membership.Regions == nil {
+		membership.Regions = make(map[string]string)
+		for host, region := range cfg.NodeRegions {
+			membership.Regions[host] = region
+		}
+		if cfg.Region != "" {
+			membership.Regions[cfg.NodeAddress] = cfg.Region
+		}
+	}
+
+	// A node removed from the cluster runs standalone
+	if !isMember(membership, cfg.NodeAddress) && membership.Version > 0 {
+		membership.Nodes = nil
+		membership.Learners = nil
+	}
+
+	c := newConsensusService(cfg, broker, repo, newNodes(membership.Nodes, cfg.NodeAddress, certs))
+	c.learners = newNodes(membership.Learners, cfg.NodeAddress, certs)
+	c.certs = certs
+	c.retention = retention
+	c.version = membership.Version
+	c.regions = membership.Regions
+	c.start()
+
+	return c
+}
+
+// newNodes creates clients for the hosts other than self.
+func newNodes(hosts []string, self string, certs *Certificates) map[string]Node {
 	nodes := make(map[string]Node)
 
-	for _, nodeHost := range cfg.Nodes {
-		node, err := NewNode(nodeHost)
+	for _, nodeHost := range hosts {
+		if nodeHost == self {
+			continue
+		}
+
+		node, err := NewNode(nodeHost, certs)
 		if err != nil {
 			slog.Error("Failed to create node client", "node", nodeHost, "error", err)
 			continue
@@ -32,50 +92,213 @@ func NewConsensusService(cfg config.Config, broker BrokerService) ConsensusServi
 		nodes[nodeHost] = node
 	}
 
-	return &consensusService{
-		nodes:  nodes,
-		topics: make(map[string]Topic),
-		broker: broker,
+	return nodes
+}
+
+// NewConsensusServiceWithNodes creates a consensus service replicating to the given nodes.
+func NewConsensusServiceWithNodes(cfg config.Config, broker BrokerService, repo data.Repository, nodes map[string]Node) ConsensusService {
+	c := newConsensusService(cfg, broker, repo, nodes)
+	c.start()
+
+	return c
+}
+
+// quorumPolicy returns the policy, falling back to a majority of all nodes for unknown ones.
+func quorumPolicy(policy string) string {
+	switch policy {
+	case QUORUM_MAJORITY, QUORUM_REGIONS, QUORUM_LOCAL:
+		return policy
+	}
+
+	slog.Error("Unknown quorum policy, using majority", "policy", policy)
+	return QUORUM_MAJORITY
+}
+
+func newConsensusService(cfg config.Config, broker BrokerService, repo data.Repository, nodes map[string]Node) *consensusService {
+	slog.Info("Creating new consensus service 🏛️")
+
+	c := &consensusService{
+		address:          cfg.NodeAddress,
+		info:             models.NodeInfo{BrokerAddress: cfg.BrokerAddress, Region: cfg.Region, Zone: cfg.Zone},
+		nodes:            nodes,
+		learners:         make(map[string]Node),
+		regions:          make(map[string]string),
+		membershipFile:   cfg.MembershipFile,
+		topics:           make(map[string]Topic),
+		pipelines:        make(map[string]*pipeline),
+		pipelineDepth:    cfg.PipelineDepth,
+		pipelineMaxBatch: cfg.PipelineMaxBatch,
+		quorumPolicy:     quorumPolicy(cfg.QuorumPolicy),
+		syncInterval:     cfg.SyncInterval,
+		detector:         newFailureDetector(cfg.HeartbeatInterval, cfg.PhiThreshold),
+		syncWindow:       cfg.SyncWindow,
+		proposeTimeout:   cfg.ProposeTimeout,
+		stableTimeout:    cfg.StableTimeout,
+		nodeTimeout:      cfg.NodeTimeout,
+		broker:           broker,
+		repo:             repo,
+	}
+
+	// Sync reaches back to the newest message stored before a restart,
+	// however long the node was down, or to the beginning without messages
+	newest, err := repo.GetNewestTimestamp(context.Background())
+	if err != nil {
+		slog.Error("Failed to get newest message, syncing the last window only", "error", err.Error())
+		newest = time.Now().UnixMicro()
+	}
+	c.syncFrom = max(0, newest-c.syncWindow.Microseconds())
+
+	// Rebuild topics from the consensus log of a previous run
+	if cfg.ConsensusLog != "" {
+		log, records, err := openConsensusLog(cfg.ConsensusLog)
+		if err != nil {
+			slog.Error("Failed to open consensus log, running without it", "path", cfg.ConsensusLog, "error", err.Error())
+		} else {
+			c.log = log
+			c.recover(records)
+		}
+	}
+
+	return c
+}
+
+// start runs the background jobs once the membership is set.
+func (c *consensusService) start() {
+	go c.deadLetterJob()
+
+	// Catch up on messages missed while this node was down, then keep comparing periodically
+	if c.syncInterval > 0 {
+		go c.SyncJob()
+	}
+
+	if c.detector != nil {
+		go c.HeartbeatJob()
 	}
 }
 
 type consensusService struct {
-	nodes  map[string]Node  // map[node_host]Node
-	topics map[string]Topic // map[topic_name]Topic
-	mu     sync.RWMutex     // protects topics
-	broker BrokerService
+	address          string               // address other nodes reach this node at
+	info             models.NodeInfo      // what this node reports in heartbeats
+	nodes            map[string]Node      // map[node_host]Node, other nodes voting in consensus
+	learners         map[string]Node      // map[node_host]Node, nodes receiving stable messages before they vote
+	version          int64                // version of the membership
+	regions          map[string]string    // map[node_host]region, of nodes, learners and this node
+	membersMu        sync.RWMutex         // protects nodes, learners, version and promised
+	changeMu         sync.Mutex           // serializes membership changes started by this node
+	promised         models.Membership    // membership agreed to for the next version
+	promisedAt       time.Time            // a promise expires after MEMBERSHIP_PROMISE_TIMEOUT
+	membershipFile   string               // empty if membership changes are not saved
+	certs            *Certificates        // creates clients of nodes added later, nil if nodes are given
+	topics           map[string]Topic     // map[topic_name]Topic
+	pipelines        map[string]*pipeline // map[topic_name]*pipeline
+	mu               sync.RWMutex         // protects topics and pipelines
+	pipelineDepth    int                  // 0 runs a separate round for every publish
+	pipelineMaxBatch int
+	quorumPolicy     string
+	clock            clock         // assigns timestamps to proposed messages
+	log              *consensusLog // nil if state transitions are not logged
+	syncInterval     time.Duration // 0 disables anti-entropy sync
+	syncWindow       time.Duration
+	syncFrom         int64            // start of the syncs until one succeeded with every node
+	synced           bool             // a sync succeeded with every node
+	retention        RetentionService // nil if sync ignores retention policies
+	detector         *failureDetector // nil if every node is assumed to be alive
+	proposeTimeout   time.Duration    // bounds of requests to other nodes
+	stableTimeout    time.Duration
+	nodeTimeout      time.Duration
+	broker           BrokerService
+	repo             data.Repository
 }
 
-func (c *consensusService) Publish(msg data.Message) (string, error) {
-	if len(c.nodes) == 0 {
-		return c.broker.Publish(msg)
+func (c *consensusService) Publish(ctx context.Context, msg data.Message) (string, error) {
+	// Batch concurrent publishes to the same topic into pipelined rounds
+	nodes, learners := c.members()
+	if c.pipelineDepth > 0 && len(nodes)+len(learners) > 0 {
+		return c.getPipeline(msg.Topic).Publish(ctx, msg)
 	}
 
-	// Prepare propose message request
-	body := msg.Body
-	msg.Body = []byte{}
-	msg.ID = uuid.NewString()
-	msg.Timestamp = time.Now().UnixMicro()
+	ids, err := c.PublishBatch(ctx, []data.Message{msg})
+	if err != nil {
+		return "", err
+	}
+
+	return ids[0], nil
+}
+
+// PublishBatch runs consensus rounds until the batch is stable. If ctx is done
+// before a quorum acknowledged the batch, the proposals are aborted on every node,
+// once it did, the batch is published anyway and only the wait for it is cut short.
+func (c *consensusService) PublishBatch(ctx context.Context, msgs []data.Message) ([]string, error) {
+	// Assign IDs and consecutive timestamps, so the batch stays in order
+	ids := make([]string, len(msgs))
+	timestamp := c.clock.reserve(0, len(msgs))
+	for i := range msgs {
+		msgs[i].ID = uuid.NewString()
+		msgs[i].Timestamp = timestamp + int64(i)
+		ids[i] = msgs[i].ID
+	}
 
-	proposeReq := models.ProposeRequest{
-		Message: msg,
+	// Messages already published with the same idempotency key are not published again.
+	// Only this node decides which messages are duplicates, the other nodes
+	// publish the stable messages as they are, so they all publish the same ones.
+	index := make(map[string]int, len(msgs)) // map[message_id]index
+	for i, msg := range msgs {
+		index[msg.ID] = i
+	}
+	duplicates := findDuplicates(c.broker, msgs)
+
+	if nodes, learners := c.members(); len(nodes)+len(learners) == 0 {
+		msgs = dropDuplicates(msgs, duplicates, index, ids)
+		if len(msgs) == 0 {
+			return ids, nil
+		}
+		if _, err := c.broker.PublishBatch(ctx, msgs); err != nil {
+			return nil, err
+		}
+		return ids, nil
+	}
+
+	// Prepare propose batch request without message bodies
+	proposeReq := models.ProposeBatchRequest{
+		Messages: make([]data.Message, len(msgs)),
+	}
+	for i, msg := range msgs {
+		msg.Body = []byte{}
+		proposeReq.Messages[i] = msg
 	}
 
 	var predecessors map[string]data.Message
 	var success bool = false
 
-	// Propose message with max 3 retries
+	// Propose batch with max 3 retries
 	for i := 0; i < 3; i++ {
-		// Propose message to self
-		rsp, err := c.Propose(proposeReq)
+		if err := ctx.Err(); err != nil {
+			c.abort(proposeReq.Messages)
+			return nil, err
+		}
+
+		// Drop duplicates and return their original IDs instead
+		if len(duplicates) > 0 {
+			msgs, proposeReq.Messages = c.dropProposedDuplicates(msgs, proposeReq.Messages, duplicates, index, ids)
+			if len(msgs) == 0 {
+				return ids, nil
+			}
+		}
+
+		// Propose batch to self
+		rsp, err := c.ProposeBatch(ctx, proposeReq)
 		if err != nil {
-			proposeReq.Message.Timestamp++
-			slog.Error("Failed to self propose message, retrying...", "error", err)
+			if ctx.Err() != nil {
+				continue
+			}
+
+			setTimestamps(proposeReq.Messages, c.clock.reserve(proposeReq.Messages[0].Timestamp, len(proposeReq.Messages)))
+			slog.Error("Failed to self propose batch, retrying...", "error", err)
 			continue
 		}
 
 		predecessors = make(map[string]data.Message)
-		highestTimestamp := proposeReq.Message.Timestamp
+		highestTimestamp := proposeReq.Messages[len(proposeReq.Messages)-1].Timestamp
 
 		for id, msg := range rsp.Predecessors {
 			if msg.Timestamp > highestTimestamp {
@@ -83,55 +306,81 @@ func (c *consensusService) Publish(msg data.Message) (string, error) {
 			}
 			predecessors[id] = msg
 		}
+		for id, original := range rsp.Duplicates {
+			duplicates[id] = original
+		}
 
 		if !rsp.Ack {
-			proposeReq.Message.Timestamp = highestTimestamp + 1
-			slog.Warn("Failed to self propose message, retrying...", "message", proposeReq.Message.ID, "topic", proposeReq.Message.Topic, "timestamp", proposeReq.Message.Timestamp)
+			setTimestamps(proposeReq.Messages, c.clock.reserve(highestTimestamp, len(proposeReq.Messages)))
+			slog.Warn("Failed to self propose batch, retrying...", "messages", len(proposeReq.Messages), "timestamp", proposeReq.Messages[0].Timestamp)
 			continue
 		}
 
-		quorum := len(c.nodes)/2 + 1
-		acks := 1
-		nacks := 0
+		// Quorum of the policy including this node, with the membership at the start of the round
+		nodes, _ := c.members()
+		quorum := newQuorum(c.quorumPolicy, c.address, nodes, c.memberRegions())
+		nodes = quorum.filter(nodes)
+
+		// Nodes suspected to be down are not asked, but still count toward the quorum
+		alive := c.detector.filter(nodes)
+		if !quorum.possible(alive) {
+			return nil, fmt.Errorf("no quorum, %d of %d nodes are alive", len(alive)+1, len(nodes)+1)
+		}
+		nodes = alive
 
 		type response struct {
-			proposeResponse models.ProposeResponse
+			host            string
+			proposeResponse models.ProposeBatchResponse
 			err             error
 		}
-		responseChan := make(chan response, len(c.nodes))
+		responseChan := make(chan response, len(nodes))
+
+		// Nodes answering after the quorum still acknowledge the batch,
+		// a client giving up before it aborts the batch on every node instead
+		proposeCtx := context.WithoutCancel(ctx)
 
-		// Propose message to all other nodes
-		for host, node := range c.nodes {
+		// Propose batch to all other nodes
+		for host, node := range nodes {
 			go func(host string, node Node) {
-				rsp, err := node.Propose(proposeReq)
+				ctx, cancel := context.WithTimeout(proposeCtx, c.proposeTimeout)
+				defer cancel()
+
+				rsp, err := node.ProposeBatch(ctx, proposeReq)
 				if err != nil {
-					slog.Error("Failed to propose message", "node", host, "error", err)
-					responseChan <- response{
-						proposeResponse: models.ProposeResponse{},
-						err:             err,
-					}
+					slog.Error("Failed to propose batch", "node", host, "error", err)
 				}
 
 				responseChan <- response{
+					host:            host,
 					proposeResponse: rsp,
+					err:             err,
 				}
-
 			}(host, node)
 		}
 
-		// Wait for quorum
-		for rsp := range responseChan {
+		// Wait for quorum or for every node to respond
+		for responses := 0; responses < len(nodes) && ctx.Err() == nil; responses++ {
+			var rsp response
+			select {
+			case rsp = <-responseChan:
+			case <-ctx.Done():
+				continue
+			}
+
 			if rsp.err != nil {
-				quorum -= 1
+				quorum.nack(rsp.host)
+				if quorum.lost() {
+					break
+				}
 				continue
 			}
 
 			proposeRsp := rsp.proposeResponse
 
 			if proposeRsp.Ack {
-				acks++
+				quorum.ack(rsp.host)
 			} else {
-				nacks++
+				quorum.nack(rsp.host)
 			}
 
 			for id, msg := range proposeRsp.Predecessors {
@@ -143,15 +392,18 @@ func (c *consensusService) Publish(msg data.Message) (string, error) {
 					predecessors[id] = msg
 				}
 			}
+			for id, original := range proposeRsp.Duplicates {
+				duplicates[id] = original
+			}
 
-			if acks >= quorum || nacks >= quorum {
+			if quorum.reached() || quorum.lost() {
 				break
 			}
 		}
 
-		if acks < quorum {
-			proposeReq.Message.Timestamp = highestTimestamp + 1
-			slog.Warn("Failed to propose message to other nodes, retrying...", "message", proposeReq.Message.ID, "topic", proposeReq.Message.Topic, "timestamp", proposeReq.Message.Timestamp)
+		if !quorum.reached() {
+			setTimestamps(proposeReq.Messages, c.clock.reserve(highestTimestamp, len(proposeReq.Messages)))
+			slog.Warn("Failed to propose batch to other nodes, retrying...", "messages", len(proposeReq.Messages), "timestamp", proposeReq.Messages[0].Timestamp)
 			continue
 		}
 
@@ -160,54 +412,212 @@ func (c *consensusService) Publish(msg data.Message) (string, error) {
 	}
 
 	if !success {
-		return "", errors.New("failed to propose message")
+		c.abort(proposeReq.Messages)
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		return nil, errors.New("failed to propose batch")
+	}
+
+	// Duplicates the nodes reported in the last round are not made stable either
+	if len(duplicates) > 0 {
+		msgs, proposeReq.Messages = c.dropProposedDuplicates(msgs, proposeReq.Messages, duplicates, index, ids)
+		if len(msgs) == 0 {
+			return ids, nil
+		}
 	}
 
-	// Prepare stable message request
-	msg.Body = body
-	stableReq := models.StableRequest{
-		Message:      msg,
+	// Prepare stable batch request with message bodies and agreed timestamps
+	for i := range msgs {
+		msgs[i].Timestamp = proposeReq.Messages[i].Timestamp
+	}
+	stableReq := models.StableBatchRequest{
+		Messages:     msgs,
 		Predecessors: predecessors,
 	}
 
-	// Stable message to all other nodes
-	for host, node := range c.nodes {
+	// The batch is decided, so it is published even if the client gives up
+	stableCtx := context.WithoutCancel(ctx)
+
+	// Stable batch to all other nodes, including learners, nodes
+	// suspected to be down pull the messages they missed once they are back
+	nodes, learners := c.members()
+	for host, node := range learners {
+		nodes[host] = node
+	}
+	for host, node := range c.detector.filter(nodes) {
 		go func(host string, node Node) {
-			err := node.Stable(stableReq)
+			ctx, cancel := context.WithTimeout(stableCtx, c.stableTimeout)
+			defer cancel()
+
+			err := node.StableBatch(ctx, stableReq)
 			if err != nil {
-				slog.Error("Failed to send stable message", "node", host, "error", err)
+				slog.Error("Failed to send stable batch", "node", host, "error", err)
 			}
 		}(host, node)
 	}
 
-	// Stable message to self
-	err := c.Stable(stableReq)
-	if err != nil {
-		return "", err
+	// Stable batch to self, which waits for the predecessors to be published
+	stableErr := make(chan error, 1)
+	go func() {
+		stableErr <- c.StableBatch(stableCtx, stableReq)
+	}()
+
+	select {
+	case err := <-stableErr:
+		if err != nil {
+			return nil, err
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// Return the IDs of the messages that won a race for their idempotency key
+	for _, msg := range msgs {
+		if msg.IdempotencyKey == "" {
+			continue
+		}
+		if id, ok := c.broker.Deduplicate(msg.IdempotencyKey); ok {
+			ids[index[msg.ID]] = id
+		}
+	}
+
+	return ids, nil
+}
+
+// findDuplicates returns the messages of the batch whose idempotency key was
+// already published, or used by an earlier message of the batch, with the IDs
+// of their original messages.
+func findDuplicates(broker BrokerService, msgs []data.Message) map[string]string {
+	duplicates := make(map[string]string) // map[message_id]original_message_id
+	seen := make(map[string]string)       // map[idempotency_key]message_id
+	for _, msg := range msgs {
+		if msg.IdempotencyKey == "" {
+			continue
+		}
+		if id, ok := seen[msg.IdempotencyKey]; ok {
+			duplicates[msg.ID] = id
+			continue
+		}
+		if id, ok := broker.Deduplicate(msg.IdempotencyKey); ok && id != msg.ID {
+			duplicates[msg.ID] = id
+			continue
+		}
+		seen[msg.IdempotencyKey] = msg.ID
+	}
+
+	return duplicates
+}
+
+// dropProposedDuplicates removes duplicate messages from the batch and from its
+// proposals, and aborts the proposals of the duplicates on every node.
+func (c *consensusService) dropProposedDuplicates(msgs []data.Message, proposed []data.Message, duplicates map[string]string, index map[string]int, ids []string) ([]data.Message, []data.Message) {
+	var aborted []data.Message
+	for _, msg := range proposed {
+		if _, ok := duplicates[msg.ID]; ok {
+			aborted = append(aborted, msg)
+		}
 	}
+	if len(aborted) == 0 {
+		return msgs, proposed
+	}
+	c.abort(aborted)
 
-	return msg.ID, nil
+	return dropDuplicates(msgs, duplicates, index, ids), dropDuplicates(proposed, duplicates, index, ids)
 }
 
-func (c *consensusService) Propose(req models.ProposeRequest) (models.ProposeResponse, error) {
+// dropDuplicates removes duplicate messages from the batch,
+// recording their original message IDs in ids.
+func dropDuplicates(msgs []data.Message, duplicates map[string]string, index map[string]int, ids []string) []data.Message {
+	result := make([]data.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if original, ok := duplicates[msg.ID]; ok {
+			ids[index[msg.ID]] = original
+			continue
+		}
+		result = append(result, msg)
+	}
+
+	return result
+}
+
+// abort withdraws proposals of this node that will not become stable, so the
+// proposals of other messages stop waiting for them before they expire.
+func (c *consensusService) abort(msgs []data.Message) {
+	req := models.AbortRequest{
+		Messages: msgs,
+	}
+
+	c.Abort(context.Background(), req)
+
+	nodes, _ := c.members()
+	for host, node := range c.detector.filter(nodes) {
+		go func(host string, node Node) {
+			ctx, cancel := context.WithTimeout(context.Background(), c.proposeTimeout)
+			defer cancel()
+
+			if err := node.Abort(ctx, req); err != nil {
+				slog.Warn("Failed to abort proposals", "node", host, "messages", len(msgs), "error", err)
+			}
+		}(host, node)
+	}
+}
+
+// setTimestamps assigns consecutive timestamps starting at timestamp.
+func setTimestamps(msgs []data.Message, timestamp int64) {
+	for i := range msgs {
+		msgs[i].Timestamp = timestamp + int64(i)
+	}
+}
+
+// deadLetterJob republishes dead letters, so they are replicated like any other message.
+func (c *consensusService) deadLetterJob() {
+	for msg := range c.broker.DeadLetters() {
+		if _, err := c.Publish(context.Background(), msg); err != nil {
+			slog.Error("Failed to publish dead letter", "topic", msg.Topic, "original", msg.Headers["original_id"], "error", err)
+		}
+	}
+}
+
+func (c *consensusService) Propose(ctx context.Context, req models.ProposeRequest) (models.ProposeResponse, error) {
+	rsp, err := c.propose(ctx, req)
+	c.log.Sync()
+
+	return rsp, err
+}
+
+func (c *consensusService) propose(ctx context.Context, req models.ProposeRequest) (models.ProposeResponse, error) {
 	slog.Debug("Receiving propose request", "message", req.Message.ID, "topic", req.Message.Topic, "timestamp", req.Message.Timestamp)
 
-	// Create topic if it does not exist
-	c.mu.Lock()
-	topic := c.topics[req.Message.Topic]
-	if topic == nil {
-		topic = NewTopic(req.Message.Topic)
-		c.topics[req.Message.Topic] = topic
+	// Report messages already published with the same idempotency key,
+	// the proposer decides whether they are dropped
+	var duplicate string
+	if req.Message.IdempotencyKey != "" {
+		if id, ok := c.broker.Deduplicate(req.Message.IdempotencyKey); ok && id != req.Message.ID {
+			slog.Debug("Propose request may be a duplicate", "message", req.Message.ID, "original", id, "topic", req.Message.Topic)
+			duplicate = id
+		}
 	}
-	c.mu.Unlock()
+
+	topic := c.getTopic(req.Message.Topic)
 
 	// And add new message if not already stable
 	if ok := topic.UpsertMessage(req.Message, ProposedState, make(Messages)); !ok {
+		if topic.GetState(req.Message.ID) == NackState {
+			slog.Debug("Propose request was aborted", "message", req.Message.ID, "topic", req.Message.Topic, "timestamp", req.Message.Timestamp)
+			return models.ProposeResponse{
+				Ack:          false,
+				Message:      req.Message,
+				Predecessors: make(Messages),
+			}, nil
+		}
+
 		slog.Warn("Propose request already stable", "message", req.Message.ID, "topic", req.Message.Topic, "timestamp", req.Message.Timestamp)
 		return models.ProposeResponse{
 			Ack:          true,
 			Message:      req.Message,
 			Predecessors: make(Messages),
+			Duplicate:    duplicate,
 		}, nil
 	}
 
@@ -223,10 +633,14 @@ func (c *consensusService) Propose(req models.ProposeRequest) (models.ProposeRes
 		}
 	}
 
-	// Wait for newer messages to be stable
+	// Wait for newer messages to be stable, a proposer that gave up gets no answer
 	ack := true
 	if len(newerMessages) > 0 {
-		predecessors := topic.WaitForStateUpdate(newerMessages, StableState)
+		predecessors, err := topic.WaitForStateUpdate(ctx, newerMessages, StableState)
+		if err != nil {
+			topic.UpsertMessage(req.Message, NackState, ackMessages)
+			return models.ProposeResponse{}, err
+		}
 		if _, ok := predecessors[req.Message.ID]; !ok {
 			ack = false
 		}
@@ -247,33 +661,219 @@ func (c *consensusService) Propose(req models.ProposeRequest) (models.ProposeRes
 		Ack:          ack,
 		Message:      req.Message,
 		Predecessors: ackMessages,
+		Duplicate:    duplicate,
 	}, nil
 }
 
-func (c *consensusService) Stable(req models.StableRequest) error {
+func (c *consensusService) Stable(ctx context.Context, req models.StableRequest) error {
 	slog.Debug("Receiving stable request", "message", req.Message.ID, "topic", req.Message.Topic, "timestamp", req.Message.Timestamp)
 
-	// Create topic if it does not exist
-	c.mu.Lock()
-	topic := c.topics[req.Message.Topic]
-	if topic == nil {
-		topic = NewTopic(req.Message.Topic)
-		c.topics[req.Message.Topic] = topic
-	}
-	c.mu.Unlock()
+	topic := c.getTopic(req.Message.Topic)
 
 	// Update predecessors and state
 	topic.UpsertMessage(req.Message, StableState, req.Predecessors)
+	c.log.Sync()
+
+	// Stable messages are decided, so they are published even if the request is canceled
+	ctx = context.WithoutCancel(ctx)
 
 	// Wait for predecessors to be published
-	topic.WaitForStateUpdate(req.Predecessors, PublishedState)
+	topic.WaitForStateUpdate(ctx, req.Predecessors, PublishedState)
 
-	// Publish message to broker
+	// Publish message to broker, then log it as published, so a node restarted
+	// in between, or after the publish failed, publishes it again instead of losing it
+	if _, err := c.broker.Publish(ctx, req.Message); err != nil {
+		return err
+	}
 	topic.UpsertMessage(req.Message, PublishedState, req.Predecessors)
-	_, err := c.broker.Publish(req.Message)
-	if err != nil {
+
+	return nil
+}
+
+func (c *consensusService) ProposeBatch(ctx context.Context, req models.ProposeBatchRequest) (models.ProposeBatchResponse, error) {
+	slog.Debug("Receiving propose batch request", "messages", len(req.Messages))
+
+	batch := make(map[string]bool, len(req.Messages))
+	for _, msg := range req.Messages {
+		batch[msg.ID] = true
+	}
+
+	// Propose every message, the batch is acknowledged only if all of them are
+	ack := true
+	predecessors := make(Messages)
+	duplicates := make(map[string]string)
+	defer c.log.Sync()
+	for _, msg := range req.Messages {
+		rsp, err := c.propose(ctx, models.ProposeRequest{
+			Message: msg,
+		})
+		if err != nil {
+			// Messages proposed before are not acknowledged either
+			c.Abort(ctx, models.AbortRequest{
+				Messages: req.Messages,
+			})
+			return models.ProposeBatchResponse{}, err
+		}
+
+		if !rsp.Ack {
+			ack = false
+		}
+		if rsp.Duplicate != "" {
+			duplicates[msg.ID] = rsp.Duplicate
+		}
+
+		// Messages of the batch are not predecessors of each other
+		for id, m := range rsp.Predecessors {
+			if !batch[id] {
+				predecessors[id] = m
+			}
+		}
+	}
+
+	return models.ProposeBatchResponse{
+		Ack:          ack,
+		Predecessors: predecessors,
+		Duplicates:   duplicates,
+	}, nil
+}
+
+func (c *consensusService) StableBatch(ctx context.Context, req models.StableBatchRequest) error {
+	slog.Debug("Receiving stable batch request", "messages", len(req.Messages))
+
+	// Update predecessors and state of every message
+	topics := make(map[string]Topic)
+	for _, msg := range req.Messages {
+		topic := c.getTopic(msg.Topic)
+		topic.UpsertMessage(msg, StableState, req.Predecessors)
+		topics[msg.Topic] = topic
+	}
+	c.log.Sync()
+
+	// Stable messages are decided, so they are published even if the request is canceled
+	ctx = context.WithoutCancel(ctx)
+
+	// Wait for predecessors to be published in every topic of the batch
+	for _, topic := range topics {
+		topic.WaitForStateUpdate(ctx, req.Predecessors, PublishedState)
+	}
+
+	// Publish the whole batch to broker at once, so it is delivered contiguously,
+	// and log it as published only once it is stored
+	if _, err := c.broker.PublishBatch(ctx, req.Messages); err != nil {
 		return err
 	}
+	for _, msg := range req.Messages {
+		topics[msg.Topic].UpsertMessage(msg, PublishedState, req.Predecessors)
+	}
 
 	return nil
 }
+
+// Abort marks proposals as not acknowledged, which releases the proposals
+// waiting for them, stable messages are not affected.
+func (c *consensusService) Abort(ctx context.Context, req models.AbortRequest) error {
+	slog.Debug("Receiving abort request", "messages", len(req.Messages))
+
+	for _, msg := range req.Messages {
+		c.getTopic(msg.Topic).UpsertMessage(msg, NackState, make(Messages))
+	}
+	c.log.Sync()
+
+	return nil
+}
+
+// recover restores topics from consensus log records
+// and finishes publishing the messages that were stable.
+func (c *consensusService) recover(records []logRecord) {
+	byTopic := make(map[string][]logRecord) // map[topic_name][]logRecord
+	stable := make(map[string][]logRecord)  // map[topic_name][]logRecord
+	stableCount := 0
+	for _, record := range records {
+		topicName := record.Message.Topic
+		byTopic[topicName] = append(byTopic[topicName], record)
+		if record.State == StableState {
+			stable[topicName] = append(stable[topicName], record)
+			stableCount++
+		}
+	}
+
+	for name, topicRecords := range byTopic {
+		t := newTopic(name, c.log)
+		t.restore(topicRecords)
+		c.topics[name] = t
+	}
+
+	// Messages stored before the restart only need to be logged as published
+	for name, topicRecords := range stable {
+		ids := make([]string, len(topicRecords))
+		for i, record := range topicRecords {
+			ids[i] = record.Message.ID
+		}
+
+		existing, err := c.repo.GetExistingIDs(ids)
+		if err != nil {
+			slog.Error("Failed to check recovered messages, publishing them again", "topic", name, "error", err.Error())
+			continue
+		}
+
+		pending := topicRecords[:0]
+		for _, record := range topicRecords {
+			if existing[record.Message.ID] {
+				c.topics[name].UpsertMessage(record.Message, PublishedState, record.predecessors())
+				stableCount--
+				continue
+			}
+			pending = append(pending, record)
+		}
+		stable[name] = pending
+	}
+
+	// Publish stable messages of every topic in timestamp order
+	for _, topicRecords := range stable {
+		sort.Slice(topicRecords, func(i, j int) bool {
+			return topicRecords[i].Message.Timestamp < topicRecords[j].Message.Timestamp
+		})
+
+		go func(topicRecords []logRecord) {
+			for _, record := range topicRecords {
+				err := c.Stable(context.Background(), models.StableRequest{
+					Message:      record.Message,
+					Predecessors: record.predecessors(),
+				})
+				if err != nil {
+					slog.Error("Failed to publish recovered message", "message", record.Message.ID, "topic", record.Message.Topic, "error", err.Error())
+				}
+			}
+		}(topicRecords)
+	}
+
+	slog.Info("Recovered consensus state", "messages", len(records), "stable", stableCount)
+}
+
+func (c *consensusService) getTopic(name string) Topic {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Create topic if it does not exist
+	topic := c.topics[name]
+	if topic == nil {
+		topic = newTopic(name, c.log)
+		c.topics[name] = topic
+	}
+
+	return topic
+}
+
+func (c *consensusService) getPipeline(topicName string) *pipeline {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Create pipeline if it does not exist
+	p := c.pipelines[topicName]
+	if p == nil {
+		p = newPipeline(topicName, c.pipelineDepth, c.pipelineMaxBatch, c.PublishBatch)
+		c.pipelines[topicName] = p
+	}
+
+	return p
+}
@@ -0,0 +1,209 @@
+package services
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"geo-distributed-message-broker/data"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+	"time"
+)
+
+// consensusLog is a write-ahead log of the state transitions of proposed
+// messages, so a restarted node can rebuild its topics.
+type consensusLog struct {
+	path    string
+	file    *os.File
+	records map[string]logRecord // map[message_id]logRecord, latest record of every message
+	mu      sync.Mutex           // protects file and records
+}
+
+type logRecord struct {
+	Message      data.Message     `json:"message"`
+	State        string           `json:"state"`
+	Predecessors map[string]int64 `json:"predecessors"` // map[message_id]timestamp
+	Expire       int64            `json:"expire"`
+}
+
+// predecessors returns the predecessors of the record as messages of its topic.
+func (r logRecord) predecessors() Messages {
+	messages := make(Messages, len(r.Predecessors))
+	for id, timestamp := range r.Predecessors {
+		messages[id] = data.Message{
+			ID:        id,
+			Timestamp: timestamp,
+			Topic:     r.Message.Topic,
+		}
+	}
+
+	return messages
+}
+
+// openConsensusLog opens the log at path and returns its live records.
+func openConsensusLog(path string) (*consensusLog, []logRecord, error) {
+	slog.Info("Opening consensus log 📒", "path", path)
+
+	l := &consensusLog{
+		path:    path,
+		records: make(map[string]logRecord),
+	}
+
+	if err := l.read(); err != nil {
+		return nil, nil, err
+	}
+
+	// Rewrite the log without expired records
+	if err := l.compact(); err != nil {
+		return nil, nil, err
+	}
+	time.AfterFunc(MESSAGE_CLEANUP, l.CompactJob)
+
+	records := make([]logRecord, 0, len(l.records))
+	for _, record := range l.records {
+		records = append(records, record)
+	}
+
+	return l, records, nil
+}
+
+func (l *consensusLog) read() error {
+	file, err := os.Open(l.path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(file))
+	for {
+		var record logRecord
+		err := decoder.Decode(&record)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			// A torn record at the end of the log was never acknowledged
+			slog.Warn("Ignoring corrupt tail of consensus log", "path", l.path, "error", err.Error())
+			return nil
+		}
+
+		l.records[record.Message.ID] = record
+	}
+}
+
+// Append writes the record before the transition takes effect,
+// it is durable after the next Sync.
+func (l *consensusLog) Append(record logRecord) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	line, err := json.Marshal(record)
+	if err != nil {
+		slog.Error("Failed to encode consensus log record", "message", record.Message.ID, "error", err.Error())
+		return
+	}
+
+	if _, err := l.file.Write(append(line, '\n')); err != nil {
+		slog.Error("Failed to write consensus log", "message", record.Message.ID, "error", err.Error())
+		return
+	}
+
+	l.records[record.Message.ID] = record
+}
+
+// Sync flushes appended records to disk, it is called once per request
+// before replying, so concurrent requests share the cost of a flush.
+func (l *consensusLog) Sync() {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	file := l.file
+	l.mu.Unlock()
+
+	// A log closed by compaction was already flushed
+	if err := file.Sync(); err != nil && !errors.Is(err, os.ErrClosed) {
+		slog.Error("Failed to sync consensus log", "path", l.path, "error", err.Error())
+	}
+}
+
+func (l *consensusLog) CompactJob() {
+	l.mu.Lock()
+	err := l.compact()
+	l.mu.Unlock()
+
+	if err != nil {
+		slog.Error("Failed to compact consensus log", "path", l.path, "error", err.Error())
+	}
+
+	time.AfterFunc(MESSAGE_CLEANUP, l.CompactJob)
+}
+
+// compact rewrites the log with the latest live record of every message,
+// the caller must hold mu or be the only user of the log.
+func (l *consensusLog) compact() error {
+	now := time.Now().Unix()
+	for id, record := range l.records {
+		// Stable records are kept until they are logged as published,
+		// however long the node was down
+		if record.Expire < now && record.State != StableState {
+			delete(l.records, id)
+		}
+	}
+
+	tmpPath := l.path + ".tmp"
+	tmp, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+
+	writer := bufio.NewWriter(tmp)
+	encoder := json.NewEncoder(writer)
+	for _, record := range l.records {
+		if err := encoder.Encode(record); err != nil {
+			tmp.Close()
+			return err
+		}
+	}
+
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmpPath, l.path); err != nil {
+		return err
+	}
+
+	// Continue appending to the compacted log
+	file, err := os.OpenFile(l.path, os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if l.file != nil {
+		l.file.Close()
+	}
+	l.file = file
+
+	return nil
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"geo-distributed-message-broker/data"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func openTestConsensusLog(t *testing.T, path string) (*consensusLog, map[string]logRecord) {
+	t.Helper()
+
+	l, records, err := openConsensusLog(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.file.Close() })
+
+	byID := make(map[string]logRecord, len(records))
+	for _, record := range records {
+		byID[record.Message.ID] = record
+	}
+
+	return l, byID
+}
+
+func TestConsensusLogRecovery(t *testing.T) {
+	expire := time.Now().Add(time.Hour).Unix()
+	m1 := data.Message{ID: "m1", Topic: "orders", Timestamp: 1}
+	m2 := data.Message{ID: "m2", Topic: "orders", Timestamp: 2}
+
+	tests := []struct {
+		name    string
+		records []logRecord
+		tail    string // appended to the log after the records
+		want    map[string]string
+	}{
+		{
+			name: "empty log",
+			want: map[string]string{},
+		},
+		{
+			name: "latest record of every message",
+			records: []logRecord{
+				{Message: m1, State: ProposedState, Expire: expire},
+				{Message: m2, State: ProposedState, Expire: expire},
+				{Message: m1, State: AckState, Expire: expire},
+				{Message: m1, State: StableState, Expire: expire, Predecessors: map[string]int64{"m0": 0}},
+			},
+			want: map[string]string{"m1": StableState, "m2": ProposedState},
+		},
+		{
+			name: "torn record at the end",
+			records: []logRecord{
+				{Message: m1, State: AckState, Expire: expire},
+			},
+			tail: `{"message":{"id":"m2","topic":"ord`,
+			want: map[string]string{"m1": AckState},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "consensus.wal")
+			l, _ := openTestConsensusLog(t, path)
+			for _, record := range tt.records {
+				l.Append(record)
+			}
+			l.Sync()
+
+			if tt.tail != "" {
+				file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+				if err != nil {
+					t.Fatal(err)
+				}
+				file.WriteString(tt.tail)
+				file.Close()
+			}
+
+			// A restarted node reads the log again
+			_, records := openTestConsensusLog(t, path)
+
+			got := make(map[string]string, len(records))
+			for id, record := range records {
+				got[id] = record.State
+			}
+			if len(got) != len(tt.want) {
+				t.Fatalf("recovered records = %v, want %v", got, tt.want)
+			}
+			for id, state := range tt.want {
+				if got[id] != state {
+					t.Errorf("state of %s = %s, want %s", id, got[id], state)
+				}
+			}
+		})
+	}
+}
+
+func TestConsensusLogRecoveryKeepsPredecessors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "consensus.wal")
+	l, _ := openTestConsensusLog(t, path)
+	l.Append(logRecord{
+		Message:      data.Message{ID: "m2", Topic: "orders", Timestamp: 2},
+		State:        StableState,
+		Predecessors: map[string]int64{"m1": 1},
+		Expire:       time.Now().Add(time.Hour).Unix(),
+	})
+	l.Sync()
+
+	_, records := openTestConsensusLog(t, path)
+
+	predecessors := records["m2"].predecessors()
+	if m, ok := predecessors["m1"]; !ok || m.Timestamp != 1 || m.Topic != "orders" {
+		t.Errorf("predecessors = %v, want m1 of orders at 1", predecessors)
+	}
+}
+
+func TestConsensusLogCompaction(t *testing.T) {
+	now := time.Now()
+	expired := now.Add(-time.Minute).Unix()
+	live := now.Add(time.Minute).Unix()
+
+	tests := []struct {
+		state  string
+		expire int64
+		kept   bool
+	}{
+		{state: ProposedState, expire: expired, kept: false},
+		{state: ProposedState, expire: live, kept: true},
+		{state: AckState, expire: expired, kept: false},
+		{state: NackState, expire: expired, kept: false},
+		{state: PublishedState, expire: expired, kept: false},
+		{state: PublishedState, expire: live, kept: true},
+		// Stable messages must still be published after a long downtime
+		{state: StableState, expire: expired, kept: true},
+		{state: StableState, expire: live, kept: true},
+	}
+
+	path := filepath.Join(t.TempDir(), "consensus.wal")
+	l, _ := openTestConsensusLog(t, path)
+
+	var want []string
+	for i, tt := range tests {
+		id := tt.state + "-" + string(rune('a'+i))
+		l.Append(logRecord{Message: data.Message{ID: id, Topic: "orders"}, State: tt.state, Expire: tt.expire})
+		if tt.kept {
+			want = append(want, id)
+		}
+	}
+	l.Sync()
+
+	l.mu.Lock()
+	err := l.compact()
+	l.mu.Unlock()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Records appended after compaction go to the compacted log
+	l.Append(logRecord{Message: data.Message{ID: "after", Topic: "orders"}, State: ProposedState, Expire: live})
+	l.Sync()
+	want = append(want, "after")
+
+	_, records := openTestConsensusLog(t, path)
+
+	var got []string
+	for id := range records {
+		got = append(got, id)
+	}
+	sort.Strings(got)
+	sort.Strings(want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("records after compaction = %v, want %v", got, want)
+	}
+}
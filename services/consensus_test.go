@@ -0,0 +1,32 @@
+package services
+
+import (
+	"context"
+	"geo-distributed-message-broker/config"
+	"geo-distributed-message-broker/data"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFindDuplicates(t *testing.T) {
+	b := newTestBrokerService(t, config.Config{DeduplicationWindow: time.Minute})
+
+	published := data.Message{ID: "m0", Topic: "orders", Timestamp: time.Now().UnixMicro(), IdempotencyKey: "k0"}
+	if _, err := b.Publish(context.Background(), published); err != nil {
+		t.Fatal(err)
+	}
+
+	msgs := []data.Message{
+		{ID: "m1", Topic: "orders", IdempotencyKey: "k0"},
+		{ID: "m2", Topic: "orders", IdempotencyKey: "k1"},
+		{ID: "m3", Topic: "orders", IdempotencyKey: "k1"},
+		{ID: "m4", Topic: "orders"},
+		{ID: "m0", Topic: "orders", IdempotencyKey: "k0"},
+	}
+	want := map[string]string{"m1": "m0", "m3": "m2"}
+
+	if got := findDuplicates(b, msgs); !reflect.DeepEqual(got, want) {
+		t.Errorf("findDuplicates() = %v, want %v", got, want)
+	}
+}
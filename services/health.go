@@ -0,0 +1,235 @@
+package services
+
+import (
+	"context"
+	"geo-distributed-message-broker/models"
+	"log/slog"
+	"math"
+	"sync"
+	"time"
+)
+
+// HEARTBEAT_WINDOW is the number of heartbeat intervals kept per node.
+const HEARTBEAT_WINDOW = 100
+
+// failureDetector is a phi accrual failure detector: the longer a node is
+// silent compared to its usual heartbeat intervals, the higher its phi,
+// and a node with phi above the threshold is suspected to be down.
+type failureDetector struct {
+	interval  time.Duration
+	threshold float64
+	nodes     map[string]*nodeHealth // map[node_host]*nodeHealth
+	mu        sync.Mutex             // protects nodes
+}
+
+type nodeHealth struct {
+	lastSeen  time.Time
+	intervals []time.Duration // latest intervals between heartbeats
+	alive     bool            // state at the last check, to log changes
+	rtt       time.Duration   // smoothed round trip of heartbeats, 0 until the first one
+	info      models.NodeInfo
+}
+
+// newFailureDetector returns nil if interval is 0, so every node is assumed to be alive.
+func newFailureDetector(interval time.Duration, threshold float64) *failureDetector {
+	if interval <= 0 {
+		return nil
+	}
+
+	return &failureDetector{
+		interval:  interval,
+		threshold: threshold,
+		nodes:     make(map[string]*nodeHealth),
+	}
+}
+
+// Alive reports whether the node is not suspected to be down,
+// nodes are alive until their heartbeats stop.
+func (d *failureDetector) Alive(host string) bool {
+	if d == nil {
+		return true
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	health, ok := d.nodes[host]
+	if !ok {
+		return true
+	}
+
+	return d.phi(health, time.Now()) < d.threshold
+}
+
+// filter returns the nodes that are alive.
+func (d *failureDetector) filter(nodes map[string]Node) map[string]Node {
+	alive := make(map[string]Node, len(nodes))
+	for host, node := range nodes {
+		if d.Alive(host) {
+			alive[host] = node
+		}
+	}
+
+	return alive
+}
+
+// Health returns the state of every tracked node.
+func (d *failureDetector) Health() map[string]models.NodeHealth {
+	if d == nil {
+		return map[string]models.NodeHealth{}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	result := make(map[string]models.NodeHealth, len(d.nodes))
+	for host, health := range d.nodes {
+		phi := d.phi(health, now)
+		result[host] = models.NodeHealth{
+			Alive:    phi < d.threshold,
+			Phi:      phi,
+			LastSeen: health.lastSeen,
+			RTT:      health.rtt,
+			Info:     health.info,
+		}
+	}
+
+	return result
+}
+
+// track starts tracking new nodes and forgets nodes that are no longer members.
+func (d *failureDetector) track(hosts map[string]Node) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for host := range d.nodes {
+		if _, ok := hosts[host]; !ok {
+			delete(d.nodes, host)
+		}
+	}
+
+	// Assume a first heartbeat now, so silent new nodes are suspected after a while
+	for host := range hosts {
+		if _, ok := d.nodes[host]; !ok {
+			d.nodes[host] = &nodeHealth{
+				lastSeen:  time.Now(),
+				intervals: []time.Duration{d.interval},
+				alive:     true,
+			}
+		}
+	}
+}
+
+// heartbeat records a heartbeat answered by the node after rtt.
+func (d *failureDetector) heartbeat(host string, info models.NodeInfo, rtt time.Duration) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	health, ok := d.nodes[host]
+	if !ok {
+		return
+	}
+
+	now := time.Now()
+
+	// The silence of a node that was down says nothing about its usual intervals
+	if d.phi(health, now) >= d.threshold {
+		health.intervals = []time.Duration{d.interval}
+		health.rtt = 0
+	} else {
+		health.intervals = append(health.intervals, now.Sub(health.lastSeen))
+		if len(health.intervals) > HEARTBEAT_WINDOW {
+			health.intervals = health.intervals[1:]
+		}
+	}
+	health.lastSeen = now
+	health.info = info
+
+	// Smooth the round trip like TCP does, so a single slow heartbeat barely moves it
+	if health.rtt == 0 {
+		health.rtt = rtt
+	} else {
+		health.rtt = (7*health.rtt + rtt) / 8
+	}
+}
+
+// check logs the nodes that went down or came back since the last check.
+func (d *failureDetector) check() {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	now := time.Now()
+	for host, health := range d.nodes {
+		phi := d.phi(health, now)
+		alive := phi < d.threshold
+		if alive == health.alive {
+			continue
+		}
+
+		health.alive = alive
+		if alive {
+			slog.Info("Node is reachable again", "node", host)
+		} else {
+			slog.Warn("Node is suspected to be down", "node", host, "phi", phi, "last_seen", health.lastSeen)
+		}
+	}
+}
+
+// phi estimates how unlikely it is that the node is still alive after its
+// silence, assuming normally distributed heartbeat intervals.
+func (d *failureDetector) phi(health *nodeHealth, now time.Time) float64 {
+	var sum float64
+	for _, interval := range health.intervals {
+		sum += float64(interval)
+	}
+	mean := sum / float64(len(health.intervals))
+
+	var squares float64
+	for _, interval := range health.intervals {
+		squares += (float64(interval) - mean) * (float64(interval) - mean)
+	}
+
+	// Tolerate jitter of half an interval even with perfectly regular heartbeats
+	stddev := math.Max(math.Sqrt(squares/float64(len(health.intervals))), float64(d.interval)/2)
+
+	// Logistic approximation of the normal cumulative distribution
+	y := (float64(now.Sub(health.lastSeen)) - mean) / stddev
+	e := math.Exp(-y * (1.5976 + 0.070566*y*y))
+	if y > 0 {
+		return -math.Log10(e / (1 + e))
+	}
+
+	return -math.Log10(1 - 1/(1+e))
+}
+
+// HeartbeatJob sends heartbeats to every member and logs changes of their health.
+func (c *consensusService) HeartbeatJob() {
+	defer time.AfterFunc(c.detector.interval, c.HeartbeatJob)
+
+	nodes, learners := c.members()
+	for host, node := range learners {
+		nodes[host] = node
+	}
+	c.detector.track(nodes)
+
+	// Heartbeats are sent concurrently, so a slow node does not delay the others
+	for host, node := range nodes {
+		go func(host string, node Node) {
+			// A heartbeat answered after the next one was sent is useless
+			ctx, cancel := context.WithTimeout(context.Background(), c.detector.interval)
+			defer cancel()
+
+			start := time.Now()
+			info, err := node.Heartbeat(ctx)
+			if err != nil {
+				slog.Debug("Failed to send heartbeat", "node", host, "error", err.Error())
+				return
+			}
+
+			c.detector.heartbeat(host, info, time.Since(start))
+		}(host, node)
+	}
+
+	c.detector.check()
+}
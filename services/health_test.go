@@ -0,0 +1,90 @@
+package services
+
+import (
+	"geo-distributed-message-broker/models"
+	"testing"
+	"time"
+)
+
+func TestFailureDetectorThreshold(t *testing.T) {
+	regular := []time.Duration{time.Second, time.Second, time.Second, time.Second}
+	jittery := []time.Duration{500 * time.Millisecond, 3 * time.Second, 500 * time.Millisecond, 3 * time.Second}
+
+	tests := []struct {
+		name      string
+		intervals []time.Duration
+		silence   time.Duration
+		alive     bool
+	}{
+		{name: "heartbeat just received", intervals: regular, silence: 0, alive: true},
+		{name: "one missed heartbeat", intervals: regular, silence: 2 * time.Second, alive: true},
+		{name: "three seconds of silence", intervals: regular, silence: 3 * time.Second, alive: true},
+		{name: "four seconds of silence", intervals: regular, silence: 4 * time.Second, alive: false},
+		{name: "long silence", intervals: regular, silence: time.Minute, alive: false},
+		{name: "jittery node after four seconds", intervals: jittery, silence: 4 * time.Second, alive: true},
+		{name: "jittery node after long silence", intervals: jittery, silence: 20 * time.Second, alive: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			d := newFailureDetector(time.Second, 8)
+			d.nodes["node2:8081"] = &nodeHealth{
+				lastSeen:  time.Now().Add(-tt.silence),
+				intervals: tt.intervals,
+				alive:     true,
+			}
+
+			if got := d.Alive("node2:8081"); got != tt.alive {
+				t.Errorf("Alive() = %v with phi %.1f, want %v", got, d.Health()["node2:8081"].Phi, tt.alive)
+			}
+		})
+	}
+}
+
+func TestFailureDetectorPhiGrowsWithSilence(t *testing.T) {
+	d := newFailureDetector(time.Second, 8)
+	health := &nodeHealth{intervals: []time.Duration{time.Second}}
+	now := time.Now()
+	health.lastSeen = now
+
+	previous := d.phi(health, now)
+	for silence := 100 * time.Millisecond; silence <= 5*time.Second; silence += 100 * time.Millisecond {
+		phi := d.phi(health, now.Add(silence))
+		if phi < previous {
+			t.Fatalf("phi after %s = %f, lower than %f before", silence, phi, previous)
+		}
+		previous = phi
+	}
+}
+
+func TestFailureDetectorTracking(t *testing.T) {
+	// Without heartbeats every node is alive
+	var disabled *failureDetector
+	if !disabled.Alive("node2:8081") {
+		t.Error("Alive() = false without failure detector")
+	}
+
+	d := newFailureDetector(time.Second, 8)
+	if !d.Alive("node2:8081") {
+		t.Error("Alive() = false for untracked node")
+	}
+
+	d.track(map[string]Node{"node2:8081": nil, "node3:8081": nil})
+	d.nodes["node2:8081"].lastSeen = time.Now().Add(-time.Minute)
+
+	// A node that comes back starts over with the usual interval
+	d.heartbeat("node2:8081", models.NodeInfo{Region: "eu"}, 10*time.Millisecond)
+	health := d.nodes["node2:8081"]
+	if len(health.intervals) != 1 || health.intervals[0] != time.Second {
+		t.Errorf("intervals after coming back = %v, want [1s]", health.intervals)
+	}
+	if !d.Alive("node2:8081") {
+		t.Error("Alive() = false right after a heartbeat")
+	}
+
+	// Removed members are forgotten
+	d.track(map[string]Node{"node2:8081": nil})
+	if _, ok := d.Health()["node3:8081"]; ok {
+		t.Error("removed node is still tracked")
+	}
+}
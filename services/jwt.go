@@ -0,0 +1,372 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"geo-distributed-message-broker/config"
+	"math/big"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	SCOPE_PUBLISH   = "publish:"   // "publish:<topic>" grants publishing to a topic or pattern
+	SCOPE_SUBSCRIBE = "subscribe:" // "subscribe:<topic>" grants subscribing to a topic or pattern
+	SCOPE_ADMIN     = "admin"
+)
+
+var ErrInvalidToken = errors.New("invalid bearer token")
+
+// tokenVerifier verifies signed JWTs issued by an identity provider
+// and maps their scopes to the grants of a user.
+type tokenVerifier struct {
+	keys       map[string]crypto.PublicKey // map[key_id]crypto.PublicKey
+	issuer     string
+	audience   string
+	scopeClaim string
+	leeway     time.Duration
+}
+
+type tokenHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+type tokenClaims struct {
+	Subject   string          `json:"sub"`
+	Issuer    string          `json:"iss"`
+	Audience  json.RawMessage `json:"aud"` // a string or a list of strings
+	ExpiresAt *float64        `json:"exp"`
+	NotBefore *float64        `json:"nbf"`
+}
+
+func newTokenVerifier(cfg config.Config) (*tokenVerifier, error) {
+	if len(cfg.JWTKeys) == 0 && cfg.JWKSFile == "" {
+		return nil, nil
+	}
+
+	if cfg.JWTAudience == "" {
+		return nil, errors.New("JWT_AUDIENCE is required to verify bearer tokens")
+	}
+
+	v := &tokenVerifier{
+		keys:       make(map[string]crypto.PublicKey),
+		issuer:     cfg.JWTIssuer,
+		audience:   cfg.JWTAudience,
+		scopeClaim: cfg.JWTScopeClaim,
+		leeway:     cfg.JWTLeeway,
+	}
+
+	// Keys from PEM files are identified by their file name without extension
+	for _, path := range cfg.JWTKeys {
+		key, err := readPublicKey(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token key %s: %w", path, err)
+		}
+
+		v.keys[strings.TrimSuffix(filepath.Base(path), filepath.Ext(path))] = key
+	}
+
+	if cfg.JWKSFile != "" {
+		keys, err := readJWKS(cfg.JWKSFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read JWKS file %s: %w", cfg.JWKSFile, err)
+		}
+
+		for kid, key := range keys {
+			v.keys[kid] = key
+		}
+	}
+
+	return v, nil
+}
+
+// verify checks the signature, expiry, issuer and audience of a token
+// and returns the user named by its subject.
+func (v *tokenVerifier) verify(token string) (User, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return User{}, fmt.Errorf("%w: malformed token", ErrInvalidToken)
+	}
+
+	var header tokenHeader
+	if err := decodeSegment(parts[0], &header); err != nil {
+		return User{}, fmt.Errorf("%w: malformed header", ErrInvalidToken)
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return User{}, fmt.Errorf("%w: malformed signature", ErrInvalidToken)
+	}
+
+	// Without a key ID every configured key is tried
+	keys := v.keys
+	if header.Kid != "" {
+		key, ok := v.keys[header.Kid]
+		if !ok {
+			return User{}, fmt.Errorf("%w: unknown key %s", ErrInvalidToken, header.Kid)
+		}
+		keys = map[string]crypto.PublicKey{header.Kid: key}
+	}
+
+	signed := []byte(parts[0] + "." + parts[1])
+	verified := false
+	for _, key := range keys {
+		if verifySignature(header.Alg, key, signed, signature) {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return User{}, fmt.Errorf("%w: invalid signature", ErrInvalidToken)
+	}
+
+	var claims tokenClaims
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return User{}, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+
+	var rawClaims map[string]json.RawMessage
+	if err := decodeSegment(parts[1], &rawClaims); err != nil {
+		return User{}, fmt.Errorf("%w: malformed claims", ErrInvalidToken)
+	}
+
+	if err := v.validate(claims); err != nil {
+		return User{}, fmt.Errorf("%w: %v", ErrInvalidToken, err)
+	}
+
+	user := User{
+		Name: claims.Subject,
+	}
+	for _, scope := range parseScopes(rawClaims[v.scopeClaim]) {
+		switch {
+		case strings.HasPrefix(scope, SCOPE_PUBLISH):
+			user.Publish = append(user.Publish, strings.TrimPrefix(scope, SCOPE_PUBLISH))
+		case strings.HasPrefix(scope, SCOPE_SUBSCRIBE):
+			user.Subscribe = append(user.Subscribe, strings.TrimPrefix(scope, SCOPE_SUBSCRIBE))
+		case scope == SCOPE_ADMIN:
+			user.Admin = true
+		}
+	}
+
+	return user, nil
+}
+
+func (v *tokenVerifier) validate(claims tokenClaims) error {
+	now := time.Now()
+
+	if claims.ExpiresAt == nil {
+		return errors.New("token has no expiry")
+	}
+	if now.After(time.Unix(int64(*claims.ExpiresAt), 0).Add(v.leeway)) {
+		return errors.New("token expired")
+	}
+	if claims.NotBefore != nil && now.Add(v.leeway).Before(time.Unix(int64(*claims.NotBefore), 0)) {
+		return errors.New("token not valid yet")
+	}
+
+	// The subject names the user, whose grants other requests rely on
+	if strings.TrimSpace(claims.Subject) == "" {
+		return errors.New("token has no subject")
+	}
+
+	if v.issuer != "" && claims.Issuer != v.issuer {
+		return fmt.Errorf("unexpected issuer %s", claims.Issuer)
+	}
+
+	var audiences []string
+	var audience string
+	if err := json.Unmarshal(claims.Audience, &audience); err == nil {
+		audiences = []string{audience}
+	} else if err := json.Unmarshal(claims.Audience, &audiences); err != nil {
+		return errors.New("token has no audience")
+	}
+	for _, a := range audiences {
+		if a == v.audience {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("token is not issued for audience %s", v.audience)
+}
+
+// parseScopes returns the scopes of a claim, either a space separated string
+// as in OAuth2 or a list of strings.
+func parseScopes(claim json.RawMessage) []string {
+	var scope string
+	if err := json.Unmarshal(claim, &scope); err == nil {
+		return strings.Fields(scope)
+	}
+
+	var scopes []string
+	if err := json.Unmarshal(claim, &scopes); err == nil {
+		return scopes
+	}
+
+	return nil
+}
+
+func decodeSegment(segment string, v any) error {
+	content, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+
+	return json.Unmarshal(content, v)
+}
+
+// verifySignature verifies a signature made with alg, the algorithm must match
+// the type of the key, so a token can not choose a weaker check.
+func verifySignature(alg string, key crypto.PublicKey, signed []byte, signature []byte) bool {
+	hash := map[string]crypto.Hash{
+		"RS256": crypto.SHA256, "RS384": crypto.SHA384, "RS512": crypto.SHA512,
+		"PS256": crypto.SHA256, "PS384": crypto.SHA384, "PS512": crypto.SHA512,
+		"ES256": crypto.SHA256, "ES384": crypto.SHA384, "ES512": crypto.SHA512,
+	}[alg]
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if hash == 0 || alg[0] == 'E' {
+			return false
+		}
+
+		h := hash.New()
+		h.Write(signed)
+		if alg[0] == 'P' {
+			return rsa.VerifyPSS(key, hash, h.Sum(nil), signature, nil) == nil
+		}
+		return rsa.VerifyPKCS1v15(key, hash, h.Sum(nil), signature) == nil
+
+	case *ecdsa.PublicKey:
+		curve := map[string]elliptic.Curve{
+			"ES256": elliptic.P256(), "ES384": elliptic.P384(), "ES512": elliptic.P521(),
+		}[alg]
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if curve == nil || key.Curve != curve || len(signature) != 2*size {
+			return false
+		}
+
+		h := hash.New()
+		h.Write(signed)
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		return ecdsa.Verify(key, h.Sum(nil), r, s)
+
+	case ed25519.PublicKey:
+		return alg == "EdDSA" && ed25519.Verify(key, signed, signature)
+	}
+
+	return false
+}
+
+// readPublicKey reads a PEM encoded public key or certificate.
+func readPublicKey(path string) (crypto.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(content)
+	if block == nil {
+		return nil, errors.New("no PEM data found")
+	}
+
+	switch block.Type {
+	case "CERTIFICATE":
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return cert.PublicKey, nil
+	case "RSA PUBLIC KEY":
+		return x509.ParsePKCS1PublicKey(block.Bytes)
+	default:
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+}
+
+// readJWKS reads the RSA, EC and Ed25519 keys of a JSON Web Key Set.
+func readJWKS(path string) (map[string]crypto.PublicKey, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var set struct {
+		Keys []struct {
+			Kty string `json:"kty"`
+			Kid string `json:"kid"`
+			Use string `json:"use"`
+			Crv string `json:"crv"`
+			N   string `json:"n"`
+			E   string `json:"e"`
+			X   string `json:"x"`
+			Y   string `json:"y"`
+		} `json:"keys"`
+	}
+	if err := json.Unmarshal(content, &set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for i, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+
+		var key crypto.PublicKey
+		switch k.Kty {
+		case "RSA":
+			n, errN := base64.RawURLEncoding.DecodeString(k.N)
+			e, errE := base64.RawURLEncoding.DecodeString(k.E)
+			if errN != nil || errE != nil {
+				return nil, fmt.Errorf("invalid RSA key %s", k.Kid)
+			}
+			key = &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(new(big.Int).SetBytes(e).Int64())}
+
+		case "EC":
+			curve := map[string]elliptic.Curve{
+				"P-256": elliptic.P256(), "P-384": elliptic.P384(), "P-521": elliptic.P521(),
+			}[k.Crv]
+			x, errX := base64.RawURLEncoding.DecodeString(k.X)
+			y, errY := base64.RawURLEncoding.DecodeString(k.Y)
+			if curve == nil || errX != nil || errY != nil {
+				return nil, fmt.Errorf("invalid EC key %s", k.Kid)
+			}
+			ecKey := &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}
+			if !curve.IsOnCurve(ecKey.X, ecKey.Y) {
+				return nil, fmt.Errorf("invalid EC key %s", k.Kid)
+			}
+			key = ecKey
+
+		case "OKP":
+			x, err := base64.RawURLEncoding.DecodeString(k.X)
+			if k.Crv != "Ed25519" || err != nil || len(x) != ed25519.PublicKeySize {
+				return nil, fmt.Errorf("invalid OKP key %s", k.Kid)
+			}
+			key = ed25519.PublicKey(x)
+
+		default:
+			continue
+		}
+
+		kid := k.Kid
+		if kid == "" {
+			kid = fmt.Sprintf("jwks-%d", i)
+		}
+		keys[kid] = key
+	}
+
+	return keys, nil
+}
@@ -0,0 +1,343 @@
+package services
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+type testKeys struct {
+	rsa     *rsa.PrivateKey
+	ec256   *ecdsa.PrivateKey
+	ec384   *ecdsa.PrivateKey
+	ed25519 ed25519.PrivateKey
+}
+
+func newTestKeys(t *testing.T) testKeys {
+	t.Helper()
+
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec256, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ec384, err := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return testKeys{rsa: rsaKey, ec256: ec256, ec384: ec384, ed25519: edKey}
+}
+
+func newTestVerifier(keys testKeys) *tokenVerifier {
+	return &tokenVerifier{
+		keys: map[string]crypto.PublicKey{
+			"rsa":     &keys.rsa.PublicKey,
+			"ec256":   &keys.ec256.PublicKey,
+			"ec384":   &keys.ec384.PublicKey,
+			"ed25519": keys.ed25519.Public(),
+		},
+		issuer:     "https://idp.example.com",
+		audience:   "broker",
+		scopeClaim: "scope",
+		leeway:     30 * time.Second,
+	}
+}
+
+func validClaims() map[string]any {
+	return map[string]any{
+		"sub":   "orders-service",
+		"iss":   "https://idp.example.com",
+		"aud":   "broker",
+		"exp":   time.Now().Add(time.Minute).Unix(),
+		"scope": "publish:orders.> subscribe:payments.*.settled",
+	}
+}
+
+// signToken signs claims with key, alg is written to the header as is,
+// so tokens can claim an algorithm that does not match their key.
+func signToken(t *testing.T, alg string, kid string, key any, claims map[string]any) string {
+	t.Helper()
+
+	header, err := json.Marshal(map[string]string{"alg": alg, "kid": kid, "typ": "JWT"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	signed := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(payload)
+
+	var signature []byte
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		digest := sha256.Sum256([]byte(signed))
+		if alg == "PS256" {
+			signature, err = rsa.SignPSS(rand.Reader, key, crypto.SHA256, digest[:], nil)
+		} else {
+			signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:])
+		}
+	case *ecdsa.PrivateKey:
+		var digest []byte
+		if key.Curve == elliptic.P384() {
+			sum := sha512.Sum384([]byte(signed))
+			digest = sum[:]
+		} else {
+			sum := sha256.Sum256([]byte(signed))
+			digest = sum[:]
+		}
+		size := (key.Curve.Params().BitSize + 7) / 8
+		r, s, signErr := ecdsa.Sign(rand.Reader, key, digest)
+		err = signErr
+		signature = append(r.FillBytes(make([]byte, size)), s.FillBytes(make([]byte, size))...)
+	case ed25519.PrivateKey:
+		signature = ed25519.Sign(key, []byte(signed))
+	case []byte:
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(signed))
+		signature = mac.Sum(nil)
+	default:
+		t.Fatalf("unsupported key %T", key)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+func TestVerifyToken(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(keys)
+
+	tests := []struct {
+		name  string
+		alg   string
+		kid   string
+		key   any
+		claim func(claims map[string]any)
+	}{
+		{name: "RS256", alg: "RS256", kid: "rsa", key: keys.rsa},
+		{name: "PS256", alg: "PS256", kid: "rsa", key: keys.rsa},
+		{name: "ES256", alg: "ES256", kid: "ec256", key: keys.ec256},
+		{name: "ES384", alg: "ES384", kid: "ec384", key: keys.ec384},
+		{name: "EdDSA", alg: "EdDSA", kid: "ed25519", key: keys.ed25519},
+		{name: "without key ID", alg: "RS256", key: keys.rsa},
+		{name: "audience list", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			c["aud"] = []string{"other", "broker"}
+		}},
+		{name: "expired within leeway", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			c["exp"] = time.Now().Add(-10 * time.Second).Unix()
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			if tt.claim != nil {
+				tt.claim(claims)
+			}
+
+			user, err := v.verify(signToken(t, tt.alg, tt.kid, tt.key, claims))
+			if err != nil {
+				t.Fatalf("verify() error = %v", err)
+			}
+			if user.Name != "orders-service" {
+				t.Errorf("user name = %s, want orders-service", user.Name)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenRejects(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(keys)
+
+	otherKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		alg   string
+		kid   string
+		key   any
+		claim func(claims map[string]any)
+	}{
+		{name: "expired", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			c["exp"] = time.Now().Add(-time.Minute).Unix()
+		}},
+		{name: "without expiry", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			delete(c, "exp")
+		}},
+		{name: "not valid yet", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			c["nbf"] = time.Now().Add(time.Minute).Unix()
+		}},
+		{name: "wrong audience", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			c["aud"] = "other"
+		}},
+		{name: "without audience", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			delete(c, "aud")
+		}},
+		{name: "without subject", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			delete(c, "sub")
+		}},
+		{name: "empty subject", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			c["sub"] = ""
+		}},
+		{name: "wrong issuer", alg: "RS256", kid: "rsa", key: keys.rsa, claim: func(c map[string]any) {
+			c["iss"] = "https://evil.example.com"
+		}},
+		{name: "unknown key ID", alg: "RS256", kid: "unknown", key: keys.rsa},
+		{name: "unknown key", alg: "RS256", key: otherKey},
+		{name: "key of another ID", alg: "RS256", kid: "rsa", key: otherKey},
+		{name: "HS256 against RSA key", alg: "HS256", kid: "rsa", key: []byte("secret")},
+		{name: "ES256 against RSA key", alg: "ES256", kid: "rsa", key: keys.ec256},
+		{name: "RS256 against EC key", alg: "RS256", kid: "ec256", key: keys.rsa},
+		{name: "ES256 against P-384 key", alg: "ES256", kid: "ec384", key: keys.ec384},
+		{name: "ES384 against P-256 key", alg: "ES384", kid: "ec256", key: keys.ec256},
+		{name: "RS256 against Ed25519 key", alg: "RS256", kid: "ed25519", key: keys.ed25519},
+		{name: "none", alg: "none", kid: "rsa", key: []byte{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			if tt.claim != nil {
+				tt.claim(claims)
+			}
+
+			_, err := v.verify(signToken(t, tt.alg, tt.kid, tt.key, claims))
+			if !errors.Is(err, ErrInvalidToken) {
+				t.Fatalf("verify() error = %v, want %v", err, ErrInvalidToken)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenRejectsTamperedClaims(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(keys)
+
+	token := signToken(t, "RS256", "rsa", keys.rsa, validClaims())
+
+	claims := validClaims()
+	claims["scope"] = "admin"
+	tampered := signToken(t, "RS256", "rsa", keys.rsa, claims)
+
+	// Claims of one token with the signature of another
+	original, forged := strings.Split(token, "."), strings.Split(tampered, ".")
+
+	if _, err := v.verify(original[0] + "." + forged[1] + "." + original[2]); !errors.Is(err, ErrInvalidToken) {
+		t.Fatalf("verify() error = %v, want %v", err, ErrInvalidToken)
+	}
+}
+
+func TestVerifyTokenScopes(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(keys)
+
+	tests := []struct {
+		name      string
+		scope     any
+		publish   []string
+		subscribe []string
+		admin     bool
+	}{
+		{
+			name:      "space separated",
+			scope:     "publish:orders.> subscribe:payments.*.settled openid",
+			publish:   []string{"orders.>"},
+			subscribe: []string{"payments.*.settled"},
+		},
+		{
+			name:      "list",
+			scope:     []string{"publish:orders.eu", "publish:orders.us", "subscribe:>", "admin"},
+			publish:   []string{"orders.eu", "orders.us"},
+			subscribe: []string{">"},
+			admin:     true,
+		},
+		{
+			name:  "missing",
+			scope: nil,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			claims := validClaims()
+			claims["scope"] = tt.scope
+
+			user, err := v.verify(signToken(t, "ES256", "ec256", keys.ec256, claims))
+			if err != nil {
+				t.Fatalf("verify() error = %v", err)
+			}
+
+			if !slices.Equal(user.Publish, tt.publish) {
+				t.Errorf("publish = %v, want %v", user.Publish, tt.publish)
+			}
+			if !slices.Equal(user.Subscribe, tt.subscribe) {
+				t.Errorf("subscribe = %v, want %v", user.Subscribe, tt.subscribe)
+			}
+			if user.Admin != tt.admin {
+				t.Errorf("admin = %v, want %v", user.Admin, tt.admin)
+			}
+		})
+	}
+}
+
+func TestVerifyTokenGrants(t *testing.T) {
+	keys := newTestKeys(t)
+	v := newTestVerifier(keys)
+
+	user, err := v.verify(signToken(t, "EdDSA", "ed25519", keys.ed25519, validClaims()))
+	if err != nil {
+		t.Fatalf("verify() error = %v", err)
+	}
+
+	tests := []struct {
+		topic     string
+		publish   bool
+		subscribe bool
+	}{
+		{topic: "orders.eu.created", publish: true},
+		{topic: "orders.>", publish: true},
+		{topic: "orders", publish: false},
+		{topic: "payments.eu.settled", subscribe: true},
+		{topic: "payments.*.settled", subscribe: true},
+		{topic: "payments.>", subscribe: false},
+		{topic: "payments.eu.failed", subscribe: false},
+	}
+
+	for _, tt := range tests {
+		if got := user.CanPublish(tt.topic); got != tt.publish {
+			t.Errorf("CanPublish(%s) = %v, want %v", tt.topic, got, tt.publish)
+		}
+		if got := user.CanSubscribe(tt.topic); got != tt.subscribe {
+			t.Errorf("CanSubscribe(%s) = %v, want %v", tt.topic, got, tt.subscribe)
+		}
+	}
+}
@@ -0,0 +1,514 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geo-distributed-message-broker/models"
+	"log/slog"
+	"maps"
+	"os"
+	"slices"
+	"sort"
+	"time"
+)
+
+const (
+	MEMBERSHIP_RETRY_INTERVAL = 5 * time.Second
+	// MEMBERSHIP_PROMISE_TIMEOUT frees the next version of a change that never completed.
+	MEMBERSHIP_PROMISE_TIMEOUT = time.Minute
+)
+
+// GetNodes returns the membership of the cluster, including this node,
+// and the health of the other nodes.
+func (c *consensusService) GetNodes() (models.Membership, map[string]models.NodeHealth, error) {
+	return c.membership(), c.detector.Health(), nil
+}
+
+func (c *consensusService) membership() models.Membership {
+	c.membersMu.RLock()
+	defer c.membersMu.RUnlock()
+
+	nodes := []string{c.address}
+	for host := range c.nodes {
+		nodes = append(nodes, host)
+	}
+	sort.Strings(nodes)
+
+	learners := []string{}
+	for host := range c.learners {
+		learners = append(learners, host)
+	}
+	sort.Strings(learners)
+
+	return models.Membership{
+		Version:  c.version,
+		Nodes:    nodes,
+		Learners: learners,
+		Regions:  maps.Clone(c.regions),
+	}
+}
+
+// memberRegions returns a copy of the regions of the members.
+func (c *consensusService) memberRegions() map[string]string {
+	c.membersMu.RLock()
+	defer c.membersMu.RUnlock()
+
+	return maps.Clone(c.regions)
+}
+
+// AddNode adds a node in a region to the cluster, first as a learner that receives
+// stable messages while it pulls older messages from the other nodes, then as a voter.
+// Adding one node at a time keeps every old quorum overlapping every new one.
+func (c *consensusService) AddNode(ctx context.Context, host string, region string) error {
+	c.changeMu.Lock()
+	defer c.changeMu.Unlock()
+
+	current := c.membership()
+	if slices.Contains(current.Nodes, host) || slices.Contains(current.Learners, host) {
+		return fmt.Errorf("node %s is already a member", host)
+	}
+	if len(current.Learners) > 0 {
+		return fmt.Errorf("node %s is still joining", current.Learners[0])
+	}
+
+	slog.Info("Adding node to cluster", "node", host, "region", region)
+
+	regions := current.Regions
+	if region != "" {
+		regions[host] = region
+	}
+
+	learning := models.Membership{
+		Version:  current.Version + 1,
+		Nodes:    current.Nodes,
+		Learners: []string{host},
+		Regions:  regions,
+	}
+	if err := c.changeMembership(ctx, learning); err != nil {
+		return err
+	}
+
+	// The new node votes only once it has the messages of the cluster,
+	// joining pulls every message, so it is bounded by ctx only
+	_, learners := c.members()
+	if err := learners[host].Join(ctx, learning); err != nil {
+		return fmt.Errorf("node %s failed to join, remove it before adding it again: %w", host, err)
+	}
+
+	voting := models.Membership{
+		Version:  learning.Version + 1,
+		Nodes:    append(slices.Clone(current.Nodes), host),
+		Learners: []string{},
+		Regions:  regions,
+	}
+
+	return c.changeMembership(ctx, voting)
+}
+
+// RemoveNode removes a voter or a learner from the cluster.
+func (c *consensusService) RemoveNode(ctx context.Context, host string) error {
+	c.changeMu.Lock()
+	defer c.changeMu.Unlock()
+
+	if host == c.address {
+		return errors.New("a node cannot remove itself, remove it through another node")
+	}
+
+	current := c.membership()
+	if !slices.Contains(current.Nodes, host) && !slices.Contains(current.Learners, host) {
+		return fmt.Errorf("node %s is not a member", host)
+	}
+
+	slog.Info("Removing node from cluster", "node", host)
+
+	delete(current.Regions, host)
+
+	return c.changeMembership(ctx, models.Membership{
+		Version:  current.Version + 1,
+		Nodes:    slices.DeleteFunc(slices.Clone(current.Nodes), func(h string) bool { return h == host }),
+		Learners: slices.DeleteFunc(slices.Clone(current.Learners), func(h string) bool { return h == host }),
+		Regions:  current.Regions,
+	})
+}
+
+// Join pulls every message from the voters, so the node can vote.
+func (c *consensusService) Join(ctx context.Context, req models.Membership) error {
+	if err := c.UpdateMembership(ctx, req); err != nil {
+		return err
+	}
+
+	// Newer messages arrive as stable messages, or are pulled by the sync job
+	nodes, _ := c.members()
+	to := time.Now().Add(-SYNC_HORIZON).UnixMicro()
+
+	pulled := 0
+	var errs []error
+	for host, node := range nodes {
+		n, err := c.sync(ctx, node, 0, to)
+		pulled += n
+		if err != nil {
+			slog.Warn("Failed to pull messages from node while joining", "node", host, "error", err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", host, err))
+		}
+	}
+
+	if len(nodes) > 0 && len(errs) == len(nodes) {
+		return errors.Join(errs...)
+	}
+
+	slog.Info("Joined cluster 🤝", "version", req.Version, "messages", pulled)
+
+	return nil
+}
+
+func (c *consensusService) UpdateMembership(ctx context.Context, req models.Membership) error {
+	removed, err := c.applyMembership(req)
+	for _, node := range removed {
+		node.Close()
+	}
+
+	return err
+}
+
+// ProposeMembership agrees to a membership for the next version, unless
+// a different membership was agreed to for that version.
+func (c *consensusService) ProposeMembership(ctx context.Context, req models.Membership) error {
+	c.membersMu.Lock()
+	defer c.membersMu.Unlock()
+
+	if req.Version <= c.version {
+		return fmt.Errorf("membership version %d is not newer than version %d", req.Version, c.version)
+	}
+	if req.Version > c.version+1 {
+		return fmt.Errorf("membership version %d skips the versions after version %d", req.Version, c.version)
+	}
+	if c.promised.Version == req.Version && time.Since(c.promisedAt) < MEMBERSHIP_PROMISE_TIMEOUT && !sameMembership(c.promised, req) {
+		return fmt.Errorf("a different membership was agreed to for version %d", req.Version)
+	}
+
+	c.promised = req
+	c.promisedAt = time.Now()
+
+	return nil
+}
+
+// agreeMembership asks the voters to agree to the membership, every voter agrees
+// to one membership per version, so of concurrent changes through different
+// nodes only one reaches a majority.
+func (c *consensusService) agreeMembership(ctx context.Context, m models.Membership) error {
+	if err := c.ProposeMembership(ctx, m); err != nil {
+		return err
+	}
+
+	nodes, _ := c.members()
+	quorum := newQuorum(QUORUM_MAJORITY, c.address, nodes, nil)
+
+	type response struct {
+		host string
+		err  error
+	}
+	responseChan := make(chan response, len(nodes))
+
+	for host, node := range nodes {
+		go func(host string, node Node) {
+			ctx, cancel := context.WithTimeout(ctx, c.nodeTimeout)
+			defer cancel()
+
+			responseChan <- response{
+				host: host,
+				err:  node.ProposeMembership(ctx, m),
+			}
+		}(host, node)
+	}
+
+	var errs []error
+	for !quorum.reached() && !quorum.lost() {
+		rsp := <-responseChan
+		if rsp.err != nil {
+			slog.Warn("Node did not agree to membership", "node", rsp.host, "version", m.Version, "error", rsp.err.Error())
+			errs = append(errs, fmt.Errorf("%s: %w", rsp.host, rsp.err))
+			quorum.nack(rsp.host)
+			continue
+		}
+		quorum.ack(rsp.host)
+	}
+
+	if !quorum.reached() {
+		return fmt.Errorf("membership version %d was not agreed to by a quorum: %w", m.Version, errors.Join(errs...))
+	}
+
+	return nil
+}
+
+// changeMembership agrees on the membership with a quorum of the voters,
+// applies it on this node and sends it to every member, and to removed nodes
+// so they stop proposing to the cluster.
+func (c *consensusService) changeMembership(ctx context.Context, m models.Membership) error {
+	if err := c.agreeMembership(ctx, m); err != nil {
+		return err
+	}
+
+	removed, err := c.applyMembership(m)
+	if err != nil {
+		return err
+	}
+
+	nodes, learners := c.members()
+	targets := make(map[string]Node, len(nodes)+len(learners)+len(removed))
+	for host, node := range nodes {
+		targets[host] = node
+	}
+	for host, node := range learners {
+		targets[host] = node
+	}
+
+	// Members that are down get the membership once they are back
+	for host, node := range targets {
+		if err := c.updateMembership(ctx, node, m); err != nil {
+			slog.Warn("Failed to update membership of node, retrying in background", "node", host, "version", m.Version, "error", err.Error())
+			go c.retryMembership(host, node, m)
+		}
+	}
+
+	// Removed nodes may be down already
+	for host, node := range removed {
+		if err := c.updateMembership(ctx, node, m); err != nil {
+			slog.Warn("Failed to update membership of removed node", "node", host, "version", m.Version, "error", err.Error())
+		}
+		node.Close()
+	}
+
+	return nil
+}
+
+// retryMembership sends the membership to a node until it succeeds,
+// or until a newer membership replaces it.
+func (c *consensusService) retryMembership(host string, node Node, m models.Membership) {
+	for {
+		time.Sleep(MEMBERSHIP_RETRY_INTERVAL)
+
+		c.membersMu.RLock()
+		version := c.version
+		c.membersMu.RUnlock()
+		if version != m.Version {
+			return
+		}
+
+		if err := c.updateMembership(context.Background(), node, m); err == nil {
+			slog.Info("Updated membership of node", "node", host, "version", m.Version)
+			return
+		}
+	}
+}
+
+func (c *consensusService) updateMembership(ctx context.Context, node Node, m models.Membership) error {
+	ctx, cancel := context.WithTimeout(ctx, c.nodeTimeout)
+	defer cancel()
+
+	return node.UpdateMembership(ctx, m)
+}
+
+// applyMembership replaces the nodes and learners of this node, reusing the
+// clients of remaining members, and returns the clients of removed ones.
+func (c *consensusService) applyMembership(m models.Membership) (map[string]Node, error) {
+	c.membersMu.Lock()
+	defer c.membersMu.Unlock()
+
+	if m.Version < c.version {
+		return nil, fmt.Errorf("membership version %d is older than version %d", m.Version, c.version)
+	}
+	if m.Version == c.version {
+		if c.conflicts(m) {
+			return nil, fmt.Errorf("membership version %d differs from the membership of this node", m.Version)
+		}
+		return nil, nil
+	}
+
+	existing := make(map[string]Node, len(c.nodes)+len(c.learners))
+	for host, node := range c.nodes {
+		existing[host] = node
+	}
+	for host, node := range c.learners {
+		existing[host] = node
+	}
+
+	var created []Node
+	connect := func(hosts []string) (map[string]Node, error) {
+		nodes := make(map[string]Node)
+		for _, host := range hosts {
+			if host == c.address {
+				continue
+			}
+
+			if node, ok := existing[host]; ok {
+				nodes[host] = node
+				delete(existing, host)
+				continue
+			}
+
+			if c.certs == nil {
+				return nil, fmt.Errorf("no certificates to create node client for %s", host)
+			}
+
+			node, err := NewNode(host, c.certs)
+			if err != nil {
+				return nil, fmt.Errorf("failed to create node client for %s: %w", host, err)
+			}
+			created = append(created, node)
+			nodes[host] = node
+		}
+
+		return nodes, nil
+	}
+
+	nodes, err := connect(m.Nodes)
+	var learners map[string]Node
+	if err == nil {
+		learners, err = connect(m.Learners)
+	}
+	if err != nil {
+		for _, node := range created {
+			node.Close()
+		}
+		return nil, err
+	}
+
+	// A removed node stops replicating and keeps serving its own messages
+	if !isMember(m, c.address) {
+		slog.Warn("This node was removed from the cluster, running standalone", "version", m.Version)
+		for host, node := range nodes {
+			existing[host] = node
+		}
+		for host, node := range learners {
+			existing[host] = node
+		}
+		nodes = make(map[string]Node)
+		learners = make(map[string]Node)
+	}
+
+	c.nodes = nodes
+	c.learners = learners
+	c.version = m.Version
+	c.regions = maps.Clone(m.Regions)
+	if c.regions == nil {
+		c.regions = make(map[string]string)
+	}
+
+	if err := saveMembership(c.membershipFile, m); err != nil {
+		slog.Error("Failed to save membership", "path", c.membershipFile, "error", err.Error())
+	}
+
+	slog.Info("Membership updated 👥", "version", m.Version, "nodes", m.Nodes, "learners", m.Learners)
+
+	return existing, nil
+}
+
+// members returns copies of the nodes and learners, so a consensus round
+// keeps the membership it started with.
+func (c *consensusService) members() (map[string]Node, map[string]Node) {
+	c.membersMu.RLock()
+	defer c.membersMu.RUnlock()
+
+	nodes := make(map[string]Node, len(c.nodes))
+	for host, node := range c.nodes {
+		nodes[host] = node
+	}
+
+	learners := make(map[string]Node, len(c.learners))
+	for host, node := range c.learners {
+		learners[host] = node
+	}
+
+	return nodes, learners
+}
+
+// conflicts reports whether m lists other members than the ones applied,
+// the caller must hold membersMu.
+func (c *consensusService) conflicts(m models.Membership) bool {
+	if !maps.Equal(m.Regions, c.regions) {
+		return true
+	}
+
+	// A removed node has no members left
+	if !isMember(m, c.address) {
+		return len(c.nodes)+len(c.learners) > 0
+	}
+
+	return !sameHosts(m.Nodes, c.address, c.nodes) || !sameHosts(m.Learners, c.address, c.learners)
+}
+
+// sameHosts reports whether hosts other than self are the hosts of nodes.
+func sameHosts(hosts []string, self string, nodes map[string]Node) bool {
+	others := 0
+	for _, host := range hosts {
+		if host == self {
+			continue
+		}
+		if _, ok := nodes[host]; !ok {
+			return false
+		}
+		others++
+	}
+
+	return others == len(nodes)
+}
+
+func sameMembership(a models.Membership, b models.Membership) bool {
+	return a.Version == b.Version &&
+		slices.Equal(sorted(a.Nodes), sorted(b.Nodes)) &&
+		slices.Equal(sorted(a.Learners), sorted(b.Learners)) &&
+		maps.Equal(a.Regions, b.Regions)
+}
+
+func sorted(hosts []string) []string {
+	hosts = slices.Clone(hosts)
+	sort.Strings(hosts)
+
+	return hosts
+}
+
+func isMember(m models.Membership, host string) bool {
+	return slices.Contains(m.Nodes, host) || slices.Contains(m.Learners, host)
+}
+
+// loadMembership reads the membership saved by a previous run,
+// a missing file returns a zero membership.
+func loadMembership(path string) (models.Membership, error) {
+	var m models.Membership
+	if path == "" {
+		return m, nil
+	}
+
+	content, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+
+	err = json.Unmarshal(content, &m)
+
+	return m, err
+}
+
+func saveMembership(path string, m models.Membership) error {
+	if path == "" {
+		return nil
+	}
+
+	content, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	// Replace the file at once, so a crash leaves either membership
+	tmpPath := path + ".tmp"
+	if err := os.WriteFile(tmpPath, content, 0600); err != nil {
+		return err
+	}
+
+	return os.Rename(tmpPath, path)
+}
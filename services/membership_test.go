@@ -0,0 +1,164 @@
+package services
+
+import (
+	"context"
+	"geo-distributed-message-broker/models"
+	"slices"
+	"sort"
+	"testing"
+	"time"
+)
+
+// testNode is a node client that can only be closed.
+type testNode struct {
+	Node
+}
+
+func (n *testNode) Close() error {
+	return nil
+}
+
+func newTestMembers(version int64, hosts ...string) *consensusService {
+	nodes := make(map[string]Node, len(hosts))
+	for _, host := range hosts {
+		nodes[host] = &testNode{}
+	}
+
+	return &consensusService{
+		address:  "node1:8081",
+		nodes:    nodes,
+		learners: map[string]Node{},
+		regions:  map[string]string{},
+		version:  version,
+	}
+}
+
+func TestProposeMembership(t *testing.T) {
+	current := []string{"node1:8081", "node2:8081"}
+	adding3 := models.Membership{Version: 2, Nodes: current, Learners: []string{"node3:8081"}}
+	adding4 := models.Membership{Version: 2, Nodes: current, Learners: []string{"node4:8081"}}
+
+	tests := []struct {
+		name       string
+		promised   models.Membership
+		promisedAt time.Time
+		req        models.Membership
+		wantErr    bool
+	}{
+		{name: "next version", req: adding3},
+		{name: "same change again", promised: adding3, promisedAt: time.Now(), req: adding3},
+		{name: "same change listed in another order", promised: adding3, promisedAt: time.Now(), req: models.Membership{Version: 2, Nodes: []string{"node2:8081", "node1:8081"}, Learners: []string{"node3:8081"}}},
+		{name: "concurrent change", promised: adding3, promisedAt: time.Now(), req: adding4, wantErr: true},
+		{name: "change after an expired promise", promised: adding3, promisedAt: time.Now().Add(-2 * MEMBERSHIP_PROMISE_TIMEOUT), req: adding4},
+		{name: "current version", req: models.Membership{Version: 1, Nodes: current}, wantErr: true},
+		{name: "skipped version", req: models.Membership{Version: 3, Nodes: current}, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestMembers(1, "node2:8081")
+			c.promised = tt.promised
+			c.promisedAt = tt.promisedAt
+
+			err := c.ProposeMembership(context.Background(), tt.req)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ProposeMembership() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && !sameMembership(c.promised, tt.req) {
+				t.Errorf("promised = %v, want %v", c.promised, tt.req)
+			}
+		})
+	}
+}
+
+func TestApplyMembership(t *testing.T) {
+	tests := []struct {
+		name        string
+		m           models.Membership
+		wantErr     bool
+		wantVersion int64
+		wantNodes   []string
+		wantRemoved []string
+	}{
+		{
+			name:        "older version",
+			m:           models.Membership{Version: 1, Nodes: []string{"node1:8081", "node2:8081"}},
+			wantErr:     true,
+			wantVersion: 2,
+			wantNodes:   []string{"node2:8081", "node3:8081"},
+		},
+		{
+			name:        "current membership again",
+			m:           models.Membership{Version: 2, Nodes: []string{"node3:8081", "node1:8081", "node2:8081"}},
+			wantVersion: 2,
+			wantNodes:   []string{"node2:8081", "node3:8081"},
+		},
+		{
+			name:        "other membership with the current version",
+			m:           models.Membership{Version: 2, Nodes: []string{"node1:8081", "node2:8081"}},
+			wantErr:     true,
+			wantVersion: 2,
+			wantNodes:   []string{"node2:8081", "node3:8081"},
+		},
+		{
+			name:        "node removed",
+			m:           models.Membership{Version: 3, Nodes: []string{"node1:8081", "node2:8081"}},
+			wantVersion: 3,
+			wantNodes:   []string{"node2:8081"},
+			wantRemoved: []string{"node3:8081"},
+		},
+		{
+			name:        "this node removed",
+			m:           models.Membership{Version: 3, Nodes: []string{"node2:8081", "node3:8081"}},
+			wantVersion: 3,
+			wantRemoved: []string{"node2:8081", "node3:8081"},
+		},
+		{
+			name:        "new node without certificates",
+			m:           models.Membership{Version: 3, Nodes: []string{"node1:8081", "node2:8081", "node3:8081"}, Learners: []string{"node4:8081"}},
+			wantErr:     true,
+			wantVersion: 2,
+			wantNodes:   []string{"node2:8081", "node3:8081"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := newTestMembers(2, "node2:8081", "node3:8081")
+			before, _ := c.members()
+
+			removed, err := c.applyMembership(tt.m)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("applyMembership() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if c.version != tt.wantVersion {
+				t.Errorf("version = %d, want %d", c.version, tt.wantVersion)
+			}
+
+			nodes, _ := c.members()
+			if got := hostsOf(nodes); !slices.Equal(got, tt.wantNodes) {
+				t.Errorf("nodes = %v, want %v", got, tt.wantNodes)
+			}
+			if got := hostsOf(removed); !slices.Equal(got, tt.wantRemoved) {
+				t.Errorf("removed = %v, want %v", got, tt.wantRemoved)
+			}
+
+			// Clients of remaining members are reused
+			for host, node := range nodes {
+				if before[host] != node {
+					t.Errorf("client of %s was replaced", host)
+				}
+			}
+		})
+	}
+}
+
+func hostsOf(nodes map[string]Node) []string {
+	hosts := make([]string, 0, len(nodes))
+	for host := range nodes {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+
+	return hosts
+}
@@ -2,12 +2,9 @@ package services
 
 import (
 	"context"
-	"crypto/tls"
-	"crypto/x509"
 	"geo-distributed-message-broker/models"
 	"geo-distributed-message-broker/pb"
 	"log/slog"
-	"os"
 
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/credentials"
@@ -15,38 +12,24 @@ import (
 
 type Node interface {
 	Close() error
-	Propose(req models.ProposeRequest) (models.ProposeResponse, error)
-	Stable(req models.StableRequest) error
+	Propose(ctx context.Context, req models.ProposeRequest) (models.ProposeResponse, error)
+	Stable(ctx context.Context, req models.StableRequest) error
+	ProposeBatch(ctx context.Context, req models.ProposeBatchRequest) (models.ProposeBatchResponse, error)
+	StableBatch(ctx context.Context, req models.StableBatchRequest) error
+	Abort(ctx context.Context, req models.AbortRequest) error
+	Forward(ctx context.Context, req models.ForwardRequest) (models.ForwardResponse, error)
+	Digest(ctx context.Context, req models.DigestRequest) (models.DigestResponse, error)
+	Pull(ctx context.Context, req models.PullRequest) (models.PullResponse, error)
+	Join(ctx context.Context, req models.Membership) error
+	ProposeMembership(ctx context.Context, req models.Membership) error
+	UpdateMembership(ctx context.Context, req models.Membership) error
+	Heartbeat(ctx context.Context) (models.NodeInfo, error)
 }
 
-func NewNode(host string) (Node, error) {
+func NewNode(host string, certs *Certificates) (Node, error) {
 	slog.Info("Creating new node client 📡", "node", host)
 
-	// read ca's cert
-	caCert, err := os.ReadFile("cert/ca-cert.pem")
-	if err != nil {
-		return nil, err
-	}
-
-	// create cert pool and append ca's cert
-	certPool := x509.NewCertPool()
-	if ok := certPool.AppendCertsFromPEM(caCert); !ok {
-		return nil, err
-	}
-
-	//read client cert
-	clientCert, err := tls.LoadX509KeyPair("cert/client-cert.pem", "cert/client-key.pem")
-	if err != nil {
-		return nil, err
-	}
-
-	// set config of tls credential
-	config := &tls.Config{
-		Certificates: []tls.Certificate{clientCert},
-		RootCAs:      certPool,
-	}
-
-	tlsCredential := credentials.NewTLS(config)
+	tlsCredential := credentials.NewTLS(certs.ClientConfig())
 
 	conn, err := grpc.Dial(host, grpc.WithTransportCredentials(tlsCredential))
 	if err != nil {
@@ -72,8 +55,8 @@ func (n *node) Close() error {
 	return n.conn.Close()
 }
 
-func (n *node) Propose(req models.ProposeRequest) (models.ProposeResponse, error) {
-	rsp, err := n.client.Propose(context.TODO(), req.ToPb())
+func (n *node) Propose(ctx context.Context, req models.ProposeRequest) (models.ProposeResponse, error) {
+	rsp, err := n.client.Propose(ctx, req.ToPb())
 	if err != nil {
 		return models.ProposeResponse{}, err
 	}
@@ -81,11 +64,101 @@ func (n *node) Propose(req models.ProposeRequest) (models.ProposeResponse, error
 	return models.ToProposeResponse(rsp), nil
 }
 
-func (n *node) Stable(req models.StableRequest) error {
-	_, err := n.client.Stable(context.TODO(), req.ToPb())
+func (n *node) Stable(ctx context.Context, req models.StableRequest) error {
+	_, err := n.client.Stable(ctx, req.ToPb())
 	if err != nil {
 		return err
 	}
 
 	return nil
 }
+
+func (n *node) ProposeBatch(ctx context.Context, req models.ProposeBatchRequest) (models.ProposeBatchResponse, error) {
+	rsp, err := n.client.ProposeBatch(ctx, req.ToPb())
+	if err != nil {
+		return models.ProposeBatchResponse{}, err
+	}
+
+	return models.ToProposeBatchResponse(rsp), nil
+}
+
+func (n *node) StableBatch(ctx context.Context, req models.StableBatchRequest) error {
+	_, err := n.client.StableBatch(ctx, req.ToPb())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (n *node) Abort(ctx context.Context, req models.AbortRequest) error {
+	_, err := n.client.Abort(ctx, req.ToPb())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (n *node) Forward(ctx context.Context, req models.ForwardRequest) (models.ForwardResponse, error) {
+	rsp, err := n.client.Forward(ctx, req.ToPb())
+	if err != nil {
+		return models.ForwardResponse{}, err
+	}
+
+	return models.ToForwardResponse(rsp), nil
+}
+
+func (n *node) Digest(ctx context.Context, req models.DigestRequest) (models.DigestResponse, error) {
+	rsp, err := n.client.Digest(ctx, req.ToPb())
+	if err != nil {
+		return models.DigestResponse{}, err
+	}
+
+	return models.ToDigestResponse(rsp), nil
+}
+
+func (n *node) Pull(ctx context.Context, req models.PullRequest) (models.PullResponse, error) {
+	rsp, err := n.client.Pull(ctx, req.ToPb())
+	if err != nil {
+		return models.PullResponse{}, err
+	}
+
+	return models.ToPullResponse(rsp), nil
+}
+
+func (n *node) Join(ctx context.Context, req models.Membership) error {
+	_, err := n.client.Join(ctx, req.ToPb())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (n *node) ProposeMembership(ctx context.Context, req models.Membership) error {
+	_, err := n.client.ProposeMembership(ctx, req.ToPb())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (n *node) UpdateMembership(ctx context.Context, req models.Membership) error {
+	_, err := n.client.UpdateMembership(ctx, req.ToPb())
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (n *node) Heartbeat(ctx context.Context) (models.NodeInfo, error) {
+	rsp, err := n.client.Heartbeat(ctx, &pb.HeartbeatRequest{})
+	if err != nil {
+		return models.NodeInfo{}, err
+	}
+
+	return models.ToNodeInfo(rsp), nil
+}
@@ -0,0 +1,193 @@
+package services
+
+import (
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"geo-distributed-message-broker/config"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	PEER_REJECTION_LOG_EVERY = 100 // rejected requests of a peer logged after the first one
+	// PEER_REJECTION_MAX_PEERS bounds the rejected peers that are counted,
+	// the peer rejected least recently is forgotten first
+	PEER_REJECTION_MAX_PEERS = 1000
+	// PEER_REJECTION_TTL forgets peers that were not rejected for a while
+	PEER_REJECTION_TTL = 1 * time.Hour
+)
+
+// PeerVerifier checks that requests to the node service come from members of the
+// cluster, identified by the DNS names and IP addresses of their client certificate,
+// or its common name if it has neither.
+type PeerVerifier struct {
+	consensus ConsensusService
+	address   string                  // address of this node
+	nodes     []string                // NODES, the members if the consensus engine keeps no membership
+	seeds     []string                // SEED_NODES, may add this node to a cluster while it has no other members
+	rejected  map[string]rejectedPeer // map[peer_identity]rejectedPeer
+	mu        sync.Mutex              // protects rejected
+}
+
+type rejectedPeer struct {
+	requests int64
+	last     time.Time
+}
+
+func NewPeerVerifier(cfg config.Config, consensus ConsensusService) *PeerVerifier {
+	slog.Info("Creating new peer verifier 🛂")
+
+	v := &PeerVerifier{
+		consensus: consensus,
+		address:   cfg.NodeAddress,
+		nodes:     cfg.Nodes,
+		seeds:     cfg.SeedNodes,
+		rejected:  make(map[string]rejectedPeer),
+	}
+	time.AfterFunc(PEER_REJECTION_TTL, v.CleanupJob)
+
+	return v
+}
+
+// Verify returns an error unless the certificate belongs to another member.
+// A node that has no other members yet accepts membership requests from its
+// configured seed nodes only, so it can be added to a cluster.
+func (v *PeerVerifier) Verify(cert *x509.Certificate, method string) error {
+	identities := peerIdentities(cert)
+
+	members := v.members()
+	if len(members) == 0 && (strings.HasSuffix(method, "/Join") || strings.HasSuffix(method, "/UpdateMembership")) {
+		members = v.seeds
+	}
+
+	for _, member := range members {
+		if member != v.address && matchesHost(identities, member) {
+			return nil
+		}
+	}
+
+	peer := strings.Join(identities, ",")
+	if peer == "" {
+		peer = cert.Subject.String()
+	}
+
+	rejected := v.reject(peer)
+
+	// Logged sparsely, so a misbehaving peer can not flood the log
+	if rejected == 1 || rejected%PEER_REJECTION_LOG_EVERY == 0 {
+		slog.Warn("Rejected request from unknown peer", "peer", peer, "method", method, "rejected", rejected)
+	}
+
+	return fmt.Errorf("peer %s is not a member of the cluster", peer)
+}
+
+// reject counts a rejected request of the peer and returns the requests rejected so far.
+func (v *PeerVerifier) reject(peer string) int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	// A peer that keeps changing its identity replaces the oldest ones
+	r, ok := v.rejected[peer]
+	if !ok && len(v.rejected) >= PEER_REJECTION_MAX_PEERS {
+		oldest := ""
+		for other, o := range v.rejected {
+			if oldest == "" || o.last.Before(v.rejected[oldest].last) {
+				oldest = other
+			}
+		}
+		delete(v.rejected, oldest)
+	}
+
+	r.requests++
+	r.last = time.Now()
+	v.rejected[peer] = r
+
+	return r.requests
+}
+
+// Rejected returns the number of rejected requests of every unknown peer.
+func (v *PeerVerifier) Rejected() map[string]int64 {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	rejected := make(map[string]int64, len(v.rejected))
+	for peer, r := range v.rejected {
+		rejected[peer] = r.requests
+	}
+
+	return rejected
+}
+
+func (v *PeerVerifier) CleanupJob() {
+	defer time.AfterFunc(PEER_REJECTION_TTL, v.CleanupJob)
+
+	expired := time.Now().Add(-PEER_REJECTION_TTL)
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	for peer, r := range v.rejected {
+		if r.last.Before(expired) {
+			delete(v.rejected, peer)
+		}
+	}
+}
+
+// members returns the nodes and learners of the membership.
+func (v *PeerVerifier) members() []string {
+	membership, _, err := v.consensus.GetNodes()
+	if errors.Is(err, errRaftUnsupported) {
+		return v.nodes
+	}
+	if err != nil {
+		return nil
+	}
+
+	members := append(membership.Nodes, membership.Learners...)
+	if len(members) == 1 && members[0] == v.address {
+		return nil
+	}
+
+	return members
+}
+
+func peerIdentities(cert *x509.Certificate) []string {
+	identities := make([]string, 0, len(cert.DNSNames)+len(cert.IPAddresses))
+	identities = append(identities, cert.DNSNames...)
+	for _, ip := range cert.IPAddresses {
+		identities = append(identities, ip.String())
+	}
+
+	if len(identities) == 0 && cert.Subject.CommonName != "" {
+		identities = append(identities, cert.Subject.CommonName)
+	}
+
+	return identities
+}
+
+// matchesHost reports whether an identity names the host of a "host:port" address.
+func matchesHost(identities []string, address string) bool {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		host = address
+	}
+	hostIP := net.ParseIP(host)
+
+	for _, identity := range identities {
+		if hostIP != nil {
+			if ip := net.ParseIP(identity); ip != nil && ip.Equal(hostIP) {
+				return true
+			}
+			continue
+		}
+
+		if strings.EqualFold(identity, host) {
+			return true
+		}
+	}
+
+	return false
+}
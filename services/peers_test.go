@@ -0,0 +1,69 @@
+package services
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestRejectedPeersAreBounded(t *testing.T) {
+	v := &PeerVerifier{rejected: make(map[string]rejectedPeer)}
+
+	v.reject("first")
+	for i := 0; i < PEER_REJECTION_MAX_PEERS+10; i++ {
+		v.reject(fmt.Sprintf("peer-%d", i))
+	}
+
+	rejected := v.Rejected()
+	if len(rejected) != PEER_REJECTION_MAX_PEERS {
+		t.Fatalf("rejected peers = %d, want %d", len(rejected), PEER_REJECTION_MAX_PEERS)
+	}
+	if _, ok := rejected["first"]; ok {
+		t.Error("peer rejected least recently was kept")
+	}
+	if rejected[fmt.Sprintf("peer-%d", PEER_REJECTION_MAX_PEERS+9)] != 1 {
+		t.Error("peer rejected most recently was not counted")
+	}
+}
+
+func TestRejectedPeersExpire(t *testing.T) {
+	v := &PeerVerifier{rejected: make(map[string]rejectedPeer)}
+
+	v.reject("old")
+	v.reject("recent")
+	v.reject("recent")
+	v.rejected["old"] = rejectedPeer{requests: 1, last: time.Now().Add(-2 * PEER_REJECTION_TTL)}
+
+	v.CleanupJob()
+
+	rejected := v.Rejected()
+	if _, ok := rejected["old"]; ok {
+		t.Error("expired peer was kept")
+	}
+	if rejected["recent"] != 2 {
+		t.Errorf("recent peer requests = %d, want 2", rejected["recent"])
+	}
+}
+
+func TestMatchesHost(t *testing.T) {
+	tests := []struct {
+		identities []string
+		address    string
+		want       bool
+	}{
+		{identities: []string{"node2"}, address: "node2:8081", want: true},
+		{identities: []string{"NODE2"}, address: "node2:8081", want: true},
+		{identities: []string{"node3"}, address: "node2:8081", want: false},
+		{identities: []string{"127.0.0.1"}, address: "127.0.0.1:8081", want: true},
+		{identities: []string{"127.0.0.2"}, address: "127.0.0.1:8081", want: false},
+		{identities: []string{"node2"}, address: "127.0.0.1:8081", want: false},
+		{identities: []string{"::1"}, address: "[::1]:8081", want: true},
+		{identities: []string{"node2"}, address: "node2", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := matchesHost(tt.identities, tt.address); got != tt.want {
+			t.Errorf("matchesHost(%v, %s) = %v, want %v", tt.identities, tt.address, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,135 @@
+package services
+
+import (
+	"context"
+	"geo-distributed-message-broker/data"
+	"log/slog"
+	"sync/atomic"
+)
+
+// pipeline batches concurrent publishes to a single topic into consensus
+// rounds and keeps up to depth rounds in flight at the same time.
+type pipeline struct {
+	topic    string
+	pending  chan pendingPublish
+	rounds   chan struct{} // one slot per round in flight
+	maxBatch int
+	publish  func(ctx context.Context, msgs []data.Message) ([]string, error)
+}
+
+type pendingPublish struct {
+	ctx     context.Context
+	message data.Message
+	result  chan publishResult
+}
+
+type publishResult struct {
+	id  string
+	err error
+}
+
+func newPipeline(topic string, depth int, maxBatch int, publish func(ctx context.Context, msgs []data.Message) ([]string, error)) *pipeline {
+	slog.Info("Creating new pipeline 🚰", "topic", topic, "depth", depth, "max_batch", maxBatch)
+
+	p := &pipeline{
+		topic:    topic,
+		pending:  make(chan pendingPublish, maxBatch),
+		rounds:   make(chan struct{}, depth),
+		maxBatch: maxBatch,
+		publish:  publish,
+	}
+	go p.run()
+
+	return p
+}
+
+// Publish queues the message for the next round and waits for its result,
+// or until ctx is done.
+func (p *pipeline) Publish(ctx context.Context, msg data.Message) (string, error) {
+	result := make(chan publishResult, 1)
+	select {
+	case p.pending <- pendingPublish{
+		ctx:     ctx,
+		message: msg,
+		result:  result,
+	}:
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+
+	select {
+	case r := <-result:
+		return r.id, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+func (p *pipeline) run() {
+	for {
+		// Wait for a free round, messages queue up in the meantime
+		p.rounds <- struct{}{}
+
+		// Take the first message and every other one already waiting,
+		// skipping messages whose publishers gave up
+		var batch []pendingPublish
+		for len(batch) == 0 {
+			batch = p.collect(<-p.pending, batch)
+		}
+	collect:
+		for len(batch) < p.maxBatch {
+			select {
+			case next := <-p.pending:
+				batch = p.collect(next, batch)
+			default:
+				break collect
+			}
+		}
+
+		go p.round(batch)
+	}
+}
+
+func (p *pipeline) collect(next pendingPublish, batch []pendingPublish) []pendingPublish {
+	if next.ctx.Err() != nil {
+		return batch
+	}
+
+	return append(batch, next)
+}
+
+func (p *pipeline) round(batch []pendingPublish) {
+	defer func() { <-p.rounds }()
+
+	// The round is aborted only once every publisher of the batch gave up
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	var waiting atomic.Int32
+	waiting.Store(int32(len(batch)))
+	for _, pending := range batch {
+		stop := context.AfterFunc(pending.ctx, func() {
+			if waiting.Add(-1) == 0 {
+				cancel()
+			}
+		})
+		defer stop()
+	}
+
+	msgs := make([]data.Message, len(batch))
+	for i, pending := range batch {
+		msgs[i] = pending.message
+	}
+
+	slog.Debug("Starting pipelined round", "topic", p.topic, "messages", len(msgs))
+
+	ids, err := p.publish(ctx, msgs)
+	for i, pending := range batch {
+		if err != nil {
+			pending.result <- publishResult{err: err}
+			continue
+		}
+
+		pending.result <- publishResult{id: ids[i]}
+	}
+}
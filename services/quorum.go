@@ -0,0 +1,134 @@
+package services
+
+const (
+	// QUORUM_MAJORITY waits for a majority of all voters.
+	QUORUM_MAJORITY = "majority"
+	// QUORUM_REGIONS waits for a majority of the voters in a majority of the regions,
+	// so a round survives the loss of a minority of regions.
+	QUORUM_REGIONS = "regions"
+	// QUORUM_LOCAL waits for a majority of the voters in the region of the proposer,
+	// other regions get the stable messages asynchronously.
+	QUORUM_LOCAL = "local"
+)
+
+// quorum counts the votes of a consensus round, voters are grouped by region
+// and a group is reached once a majority of its voters acknowledged.
+type quorum struct {
+	groups map[string]*quorumGroup // map[region]*quorumGroup
+	voters map[string]string       // map[node_host]region, nodes asked to vote
+	need   int                     // groups to reach
+}
+
+type quorumGroup struct {
+	size  int // voters including this node
+	acks  int
+	nacks int
+}
+
+func (g *quorumGroup) majority() int {
+	return g.size/2 + 1
+}
+
+// newQuorum returns the quorum of a round proposed by this node to nodes,
+// this node acknowledges its own proposal.
+func newQuorum(policy string, self string, nodes map[string]Node, regions map[string]string) *quorum {
+	q := &quorum{
+		groups: make(map[string]*quorumGroup),
+		voters: make(map[string]string),
+	}
+
+	group := func(host string) string {
+		if policy == QUORUM_MAJORITY {
+			return ""
+		}
+		return regions[host]
+	}
+
+	selfGroup := group(self)
+	q.groups[selfGroup] = &quorumGroup{size: 1, acks: 1}
+	for host := range nodes {
+		g := group(host)
+		if policy == QUORUM_LOCAL && g != selfGroup {
+			continue
+		}
+
+		if q.groups[g] == nil {
+			q.groups[g] = &quorumGroup{}
+		}
+		q.groups[g].size++
+		q.voters[host] = g
+	}
+
+	q.need = 1
+	if policy == QUORUM_REGIONS {
+		q.need = len(q.groups)/2 + 1
+	}
+
+	return q
+}
+
+// filter returns the nodes asked to vote.
+func (q *quorum) filter(nodes map[string]Node) map[string]Node {
+	voters := make(map[string]Node, len(q.voters))
+	for host, node := range nodes {
+		if _, ok := q.voters[host]; ok {
+			voters[host] = node
+		}
+	}
+
+	return voters
+}
+
+func (q *quorum) ack(host string) {
+	if g, ok := q.groups[q.voters[host]]; ok {
+		g.acks++
+	}
+}
+
+func (q *quorum) nack(host string) {
+	if g, ok := q.groups[q.voters[host]]; ok {
+		g.nacks++
+	}
+}
+
+func (q *quorum) reached() bool {
+	reached := 0
+	for _, g := range q.groups {
+		if g.acks >= g.majority() {
+			reached++
+		}
+	}
+
+	return reached >= q.need
+}
+
+// lost reports whether the remaining votes cannot reach the quorum anymore.
+func (q *quorum) lost() bool {
+	lost := 0
+	for _, g := range q.groups {
+		if g.nacks > g.size-g.majority() {
+			lost++
+		}
+	}
+
+	return lost > len(q.groups)-q.need
+}
+
+// possible reports whether the quorum can be reached if every alive node acknowledges.
+func (q *quorum) possible(alive map[string]Node) bool {
+	reachable := 0
+	for name, g := range q.groups {
+		votes := g.acks
+		for host, group := range q.voters {
+			if _, ok := alive[host]; ok && group == name {
+				votes++
+			}
+		}
+
+		if votes >= g.majority() {
+			reachable++
+		}
+	}
+
+	return reachable >= q.need
+}
@@ -0,0 +1,115 @@
+package services
+
+import (
+	"slices"
+	"testing"
+)
+
+// Nodes of the quorum tests, proposed to by node "a" in region eu.
+var (
+	quorumNodes   = map[string]Node{"b": nil, "c": nil, "d": nil, "e": nil, "f": nil}
+	quorumRegions = map[string]string{"a": "eu", "b": "eu", "c": "eu", "d": "us", "e": "us", "f": "ap"}
+)
+
+func TestQuorum(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  string
+		acks    []string
+		nacks   []string
+		reached bool
+		lost    bool
+	}{
+		{name: "majority without votes", policy: QUORUM_MAJORITY},
+		{name: "majority of all nodes", policy: QUORUM_MAJORITY, acks: []string{"b", "d", "f"}, reached: true},
+		{name: "half of all nodes", policy: QUORUM_MAJORITY, acks: []string{"b", "c"}, nacks: []string{"d"}},
+		{name: "majority lost", policy: QUORUM_MAJORITY, acks: []string{"b"}, nacks: []string{"c", "d", "e"}, lost: true},
+		{name: "regions in one region only", policy: QUORUM_REGIONS, acks: []string{"b", "c"}},
+		{name: "regions in two regions", policy: QUORUM_REGIONS, acks: []string{"b", "f"}, reached: true},
+		{name: "regions with half of a region", policy: QUORUM_REGIONS, acks: []string{"b", "d"}},
+		{name: "regions with a whole region", policy: QUORUM_REGIONS, acks: []string{"b", "d", "e"}, reached: true},
+		{name: "regions lost", policy: QUORUM_REGIONS, acks: []string{"b"}, nacks: []string{"d", "f"}, lost: true},
+		{name: "local majority", policy: QUORUM_LOCAL, acks: []string{"b"}, reached: true},
+		{name: "local ignores other regions", policy: QUORUM_LOCAL, acks: []string{"d", "e", "f"}},
+		{name: "local lost", policy: QUORUM_LOCAL, acks: []string{"d"}, nacks: []string{"b", "c"}, lost: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuorum(tt.policy, "a", quorumNodes, quorumRegions)
+			for _, host := range tt.acks {
+				q.ack(host)
+			}
+			for _, host := range tt.nacks {
+				q.nack(host)
+			}
+
+			if got := q.reached(); got != tt.reached {
+				t.Errorf("reached() = %v, want %v", got, tt.reached)
+			}
+			if got := q.lost(); got != tt.lost {
+				t.Errorf("lost() = %v, want %v", got, tt.lost)
+			}
+		})
+	}
+}
+
+func TestQuorumVoters(t *testing.T) {
+	tests := []struct {
+		name     string
+		policy   string
+		alive    []string
+		voters   []string
+		possible bool
+	}{
+		{name: "majority with every node alive", policy: QUORUM_MAJORITY, alive: []string{"b", "c", "d", "e", "f"}, voters: []string{"b", "c", "d", "e", "f"}, possible: true},
+		{name: "majority with half of the nodes alive", policy: QUORUM_MAJORITY, alive: []string{"b", "c"}, voters: []string{"b", "c", "d", "e", "f"}},
+		{name: "majority with a majority alive", policy: QUORUM_MAJORITY, alive: []string{"b", "c", "d"}, voters: []string{"b", "c", "d", "e", "f"}, possible: true},
+		{name: "regions with two regions alive", policy: QUORUM_REGIONS, alive: []string{"b", "f"}, voters: []string{"b", "c", "d", "e", "f"}, possible: true},
+		{name: "regions with one region alive", policy: QUORUM_REGIONS, alive: []string{"d", "e"}, voters: []string{"b", "c", "d", "e", "f"}},
+		{name: "local with the region alive", policy: QUORUM_LOCAL, alive: []string{"c"}, voters: []string{"b", "c"}, possible: true},
+		{name: "local with other regions alive", policy: QUORUM_LOCAL, alive: []string{"d", "e", "f"}, voters: []string{"b", "c"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			q := newQuorum(tt.policy, "a", quorumNodes, quorumRegions)
+
+			voters := make([]string, 0, len(quorumNodes))
+			for host := range q.filter(quorumNodes) {
+				voters = append(voters, host)
+			}
+			slices.Sort(voters)
+			if !slices.Equal(voters, tt.voters) {
+				t.Errorf("filter() = %v, want %v", voters, tt.voters)
+			}
+
+			alive := make(map[string]Node, len(tt.alive))
+			for _, host := range tt.alive {
+				alive[host] = nil
+			}
+			if got := q.possible(alive); got != tt.possible {
+				t.Errorf("possible() = %v, want %v", got, tt.possible)
+			}
+		})
+	}
+}
+
+func TestQuorumPolicy(t *testing.T) {
+	tests := []struct {
+		policy string
+		want   string
+	}{
+		{policy: QUORUM_MAJORITY, want: QUORUM_MAJORITY},
+		{policy: QUORUM_REGIONS, want: QUORUM_REGIONS},
+		{policy: QUORUM_LOCAL, want: QUORUM_LOCAL},
+		{policy: "", want: QUORUM_MAJORITY},
+		{policy: "unknown", want: QUORUM_MAJORITY},
+	}
+
+	for _, tt := range tests {
+		if got := quorumPolicy(tt.policy); got != tt.want {
+			t.Errorf("quorumPolicy(%q) = %s, want %s", tt.policy, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,300 @@
+package services
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"geo-distributed-message-broker/config"
+	"geo-distributed-message-broker/data"
+	"geo-distributed-message-broker/models"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/hashicorp/go-hclog"
+	"github.com/hashicorp/raft"
+	raftboltdb "github.com/hashicorp/raft-boltdb/v2"
+)
+
+const RAFT_APPLY_TIMEOUT = 10 * time.Second
+
+var errRaftUnsupported = errors.New("not supported by raft consensus")
+
+// NewRaftConsensusService creates a consensus service that replicates
+// messages through a cluster-wide raft log instead of timestamp voting.
+func NewRaftConsensusService(cfg config.Config, broker BrokerService, repo data.Repository, certs *Certificates) (ConsensusService, error) {
+	slog.Info("Creating new raft consensus service 🚣")
+
+	if len(cfg.RaftNodes) != len(cfg.Nodes) {
+		return nil, errors.New("RAFT_NODES must list one raft address for every node in NODES")
+	}
+
+	// Node clients are used to forward publishes to the leader
+	nodes := make(map[string]Node)
+	for i, nodeHost := range cfg.Nodes {
+		node, err := NewNode(nodeHost, certs)
+		if err != nil {
+			slog.Error("Failed to create node client", "node", nodeHost, "error", err)
+			continue
+		}
+
+		nodes[cfg.RaftNodes[i]] = node
+	}
+
+	if err := os.MkdirAll(cfg.RaftDir, 0700); err != nil {
+		return nil, err
+	}
+
+	store, err := raftboltdb.NewBoltStore(filepath.Join(cfg.RaftDir, "raft.db"))
+	if err != nil {
+		return nil, err
+	}
+
+	snapshots, err := raft.NewFileSnapshotStore(cfg.RaftDir, 2, os.Stderr)
+	if err != nil {
+		return nil, err
+	}
+
+	streamLayer, err := newRaftStreamLayer(cfg.RaftPort, cfg.RaftAddress, cfg.RaftNodes, certs)
+	if err != nil {
+		return nil, err
+	}
+	transport := raft.NewNetworkTransport(streamLayer, 3, 10*time.Second, os.Stderr)
+
+	raftConfig := raft.DefaultConfig()
+	raftConfig.LocalID = raft.ServerID(cfg.RaftAddress)
+	raftConfig.Logger = hclog.New(&hclog.LoggerOptions{
+		Name:   "raft",
+		Level:  hclog.Warn,
+		Output: os.Stdout,
+	})
+	// Messages are already in the database, only the log after it is replayed
+	raftConfig.NoSnapshotRestoreOnStart = true
+
+	fsm := &raftFSM{
+		broker: broker,
+		repo:   repo,
+	}
+
+	r, err := raft.NewRaft(raftConfig, fsm, store, store, snapshots, transport)
+	if err != nil {
+		return nil, err
+	}
+
+	// Every node bootstraps the same configuration, which is ignored once a cluster exists
+	servers := []raft.Server{{ID: raft.ServerID(cfg.RaftAddress), Address: raft.ServerAddress(cfg.RaftAddress)}}
+	for _, address := range cfg.RaftNodes {
+		servers = append(servers, raft.Server{ID: raft.ServerID(address), Address: raft.ServerAddress(address)})
+	}
+
+	err = r.BootstrapCluster(raft.Configuration{Servers: servers}).Error()
+	if err != nil && err != raft.ErrCantBootstrap {
+		return nil, err
+	}
+
+	c := &raftConsensusService{
+		raft:        r,
+		nodes:       nodes,
+		nodeTimeout: cfg.NodeTimeout,
+		broker:      broker,
+		pending:     map[string]string{},
+	}
+	go c.deadLetterJob()
+
+	return c, nil
+}
+
+type raftConsensusService struct {
+	raft        *raft.Raft
+	nodes       map[string]Node // map[raft_address]Node
+	clock       clock           // assigns timestamps to messages appended by the leader
+	nodeTimeout time.Duration   // bounds forwarding to the leader
+	broker      BrokerService
+	pending     map[string]string // map[idempotency_key]message_id of entries being applied
+	mu          sync.Mutex        // protects pending
+}
+
+func (c *raftConsensusService) Publish(ctx context.Context, msg data.Message) (string, error) {
+	ids, err := c.PublishBatch(ctx, []data.Message{msg})
+	if err != nil {
+		return "", err
+	}
+
+	return ids[0], nil
+}
+
+func (c *raftConsensusService) PublishBatch(ctx context.Context, msgs []data.Message) ([]string, error) {
+	// Only the leader appends to the log
+	if c.raft.State() != raft.Leader {
+		return c.forward(ctx, msgs)
+	}
+
+	// Assign IDs and consecutive timestamps, so the batch stays in order
+	timestamp := c.clock.reserve(0, len(msgs))
+	for i := range msgs {
+		msgs[i].ID = uuid.NewString()
+		msgs[i].Timestamp = timestamp + int64(i)
+	}
+
+	// Decide which messages are duplicates, including the ones of entries
+	// still being applied, and log the decisions with the messages
+	duplicates, reserved := c.deduplicate(msgs)
+	defer c.release(reserved)
+
+	entry, err := json.Marshal(raftEntry{
+		Messages:   msgs,
+		Duplicates: duplicates,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// An entry is applied once it is appended, ctx only bounds the wait to append it
+	timeout := RAFT_APPLY_TIMEOUT
+	if deadline, ok := ctx.Deadline(); ok {
+		timeout = min(timeout, time.Until(deadline))
+	}
+
+	future := c.raft.Apply(entry, timeout)
+	if err := future.Error(); err != nil {
+		return nil, err
+	}
+
+	result := future.Response().(raftApplyResult)
+	if result.err != nil {
+		return nil, result.err
+	}
+
+	return result.ids, nil
+}
+
+// deduplicate returns the messages whose idempotency key was already published,
+// or is used by an entry being applied, and reserves the keys of the other ones.
+func (c *raftConsensusService) deduplicate(msgs []data.Message) (map[string]string, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	var reserved []string
+	duplicates := findDuplicates(c.broker, msgs)
+	for _, msg := range msgs {
+		if _, ok := duplicates[msg.ID]; ok || msg.IdempotencyKey == "" {
+			continue
+		}
+		if id, ok := c.pending[msg.IdempotencyKey]; ok {
+			duplicates[msg.ID] = id
+			continue
+		}
+		c.pending[msg.IdempotencyKey] = msg.ID
+		reserved = append(reserved, msg.IdempotencyKey)
+	}
+
+	return duplicates, reserved
+}
+
+// release removes the reservations of keys whose entry was applied or failed.
+func (c *raftConsensusService) release(keys []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, key := range keys {
+		delete(c.pending, key)
+	}
+}
+
+// forward sends the messages to the leader, which publishes them.
+func (c *raftConsensusService) forward(ctx context.Context, msgs []data.Message) ([]string, error) {
+	leader, _ := c.raft.LeaderWithID()
+	if leader == "" {
+		return nil, errors.New("no raft leader")
+	}
+
+	node, ok := c.nodes[string(leader)]
+	if !ok {
+		return nil, fmt.Errorf("no node client for raft leader %s", leader)
+	}
+
+	slog.Debug("Forwarding batch to raft leader", "leader", leader, "messages", len(msgs))
+
+	ctx, cancel := context.WithTimeout(ctx, c.nodeTimeout)
+	defer cancel()
+
+	rsp, err := node.Forward(ctx, models.ForwardRequest{
+		Messages: msgs,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return rsp.IDs, nil
+}
+
+// deadLetterJob republishes dead letters, so they are replicated like any other message.
+func (c *raftConsensusService) deadLetterJob() {
+	for msg := range c.broker.DeadLetters() {
+		if _, err := c.Publish(context.Background(), msg); err != nil {
+			slog.Error("Failed to publish dead letter", "topic", msg.Topic, "original", msg.Headers["original_id"], "error", err)
+		}
+	}
+}
+
+func (c *raftConsensusService) Propose(ctx context.Context, req models.ProposeRequest) (models.ProposeResponse, error) {
+	return models.ProposeResponse{}, errRaftUnsupported
+}
+
+func (c *raftConsensusService) Stable(ctx context.Context, req models.StableRequest) error {
+	return errRaftUnsupported
+}
+
+func (c *raftConsensusService) ProposeBatch(ctx context.Context, req models.ProposeBatchRequest) (models.ProposeBatchResponse, error) {
+	return models.ProposeBatchResponse{}, errRaftUnsupported
+}
+
+func (c *raftConsensusService) StableBatch(ctx context.Context, req models.StableBatchRequest) error {
+	return errRaftUnsupported
+}
+
+func (c *raftConsensusService) Abort(ctx context.Context, req models.AbortRequest) error {
+	return errRaftUnsupported
+}
+
+// Digest and Pull are not needed, raft catches up lagging nodes from its log.
+func (c *raftConsensusService) Digest(ctx context.Context, req models.DigestRequest) (models.DigestResponse, error) {
+	return models.DigestResponse{}, errRaftUnsupported
+}
+
+func (c *raftConsensusService) Pull(ctx context.Context, req models.PullRequest) (models.PullResponse, error) {
+	return models.PullResponse{}, errRaftUnsupported
+}
+
+// Membership of a raft cluster is fixed by RAFT_NODES.
+func (c *raftConsensusService) AddNode(ctx context.Context, host string, region string) error {
+	return errRaftUnsupported
+}
+
+func (c *raftConsensusService) RemoveNode(ctx context.Context, host string) error {
+	return errRaftUnsupported
+}
+
+func (c *raftConsensusService) GetNodes() (models.Membership, map[string]models.NodeHealth, error) {
+	return models.Membership{}, nil, errRaftUnsupported
+}
+
+func (c *raftConsensusService) GetTopology() ([]models.Endpoint, error) {
+	return nil, errRaftUnsupported
+}
+
+func (c *raftConsensusService) Join(ctx context.Context, req models.Membership) error {
+	return errRaftUnsupported
+}
+
+func (c *raftConsensusService) ProposeMembership(ctx context.Context, req models.Membership) error {
+	return errRaftUnsupported
+}
+
+func (c *raftConsensusService) UpdateMembership(ctx context.Context, req models.Membership) error {
+	return errRaftUnsupported
+}
@@ -0,0 +1,212 @@
+package services
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"geo-distributed-message-broker/data"
+	"io"
+	"log/slog"
+
+	"github.com/hashicorp/raft"
+)
+
+// raftFSM applies committed batches of messages to the broker.
+// Messages live in the database, so applying the log is idempotent
+// and the log can be replayed on top of the stored messages.
+type raftFSM struct {
+	broker BrokerService
+	repo   data.Repository
+}
+
+// raftEntry is a batch of messages in the raft log. The leader decides which
+// messages are duplicates when appending it, so every node applies it the same way.
+type raftEntry struct {
+	Messages   []data.Message    `json:"messages"`
+	Duplicates map[string]string `json:"duplicates"` // map[message_id]original_message_id
+	legacy     bool              // written by an older version, without the decisions
+}
+
+type raftApplyResult struct {
+	ids []string
+	err error
+}
+
+func (f *raftFSM) Apply(log *raft.Log) interface{} {
+	entry, err := decodeRaftEntry(log.Data)
+	if err != nil {
+		slog.Error("Failed to decode raft log entry", "index", log.Index, "error", err.Error())
+		return raftApplyResult{err: err}
+	}
+	msgs := entry.Messages
+	if entry.legacy {
+		entry.Duplicates = findDuplicates(f.broker, msgs)
+	}
+
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+
+	// Skip messages already stored before a restart
+	existing, err := f.repo.GetExistingIDs(ids)
+	if err != nil {
+		return raftApplyResult{err: err}
+	}
+
+	// Duplicates are replaced by the IDs of their original messages
+	batch := make([]data.Message, 0, len(msgs))
+	for i, msg := range msgs {
+		if original, ok := entry.Duplicates[msg.ID]; ok {
+			ids[i] = original
+			continue
+		}
+		if !existing[msg.ID] {
+			batch = append(batch, msg)
+		}
+	}
+
+	if len(batch) == 0 {
+		return raftApplyResult{ids: ids}
+	}
+
+	if _, err := f.broker.PublishBatch(context.Background(), batch); err != nil {
+		slog.Error("Failed to apply raft log entry", "index", log.Index, "error", err.Error())
+		return raftApplyResult{err: err}
+	}
+
+	return raftApplyResult{ids: ids}
+}
+
+// decodeRaftEntry decodes a log entry. Entries written by older versions are
+// plain batches of messages, whose duplicates are still found when applying them.
+func decodeRaftEntry(raw []byte) (raftEntry, error) {
+	if len(raw) > 0 && raw[0] == '[' {
+		var msgs []data.Message
+		if err := json.Unmarshal(raw, &msgs); err != nil {
+			return raftEntry{}, err
+		}
+		return raftEntry{Messages: msgs, legacy: true}, nil
+	}
+
+	var entry raftEntry
+	err := json.Unmarshal(raw, &entry)
+
+	return entry, err
+}
+
+// Snapshot captures the stored messages in a read transaction. Raft does not
+// apply entries while it runs, so the snapshot matches the applied index.
+func (f *raftFSM) Snapshot() (raft.FSMSnapshot, error) {
+	snapshot, err := f.repo.Snapshot(context.Background())
+	if err != nil {
+		return nil, err
+	}
+
+	return &raftSnapshot{snapshot: snapshot}, nil
+}
+
+// Restore stores the messages of a snapshot that are missing locally.
+func (f *raftFSM) Restore(snapshot io.ReadCloser) error {
+	defer snapshot.Close()
+
+	decoder := json.NewDecoder(bufio.NewReader(snapshot))
+	restored := 0
+	batch := make([]data.Message, 0, 100)
+
+	flush := func() error {
+		if len(batch) == 0 {
+			return nil
+		}
+
+		ids := make([]string, len(batch))
+		for i, msg := range batch {
+			ids[i] = msg.ID
+		}
+
+		existing, err := f.repo.GetExistingIDs(ids)
+		if err != nil {
+			return err
+		}
+
+		missing := make([]data.Message, 0, len(batch))
+		for _, msg := range batch {
+			if !existing[msg.ID] {
+				missing = append(missing, msg)
+			}
+		}
+
+		if len(missing) > 0 {
+			if err := f.repo.CreateMessages(context.Background(), missing); err != nil {
+				return err
+			}
+			restored += len(missing)
+		}
+
+		batch = batch[:0]
+		return nil
+	}
+
+	for {
+		var msg data.Message
+		err := decoder.Decode(&msg)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		batch = append(batch, msg)
+		if len(batch) == cap(batch) {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if err := flush(); err != nil {
+		return err
+	}
+
+	slog.Info("Restored raft snapshot", "messages", restored)
+
+	return nil
+}
+
+// raftSnapshot writes every message of the snapshot as a JSON line.
+type raftSnapshot struct {
+	snapshot data.Snapshot
+}
+
+func (s *raftSnapshot) Persist(sink raft.SnapshotSink) error {
+	err := s.write(sink)
+	if err != nil {
+		sink.Cancel()
+		return err
+	}
+
+	return sink.Close()
+}
+
+func (s *raftSnapshot) write(sink raft.SnapshotSink) error {
+	writer := bufio.NewWriter(sink)
+	encoder := json.NewEncoder(writer)
+	err := s.snapshot.ForEachBatch(func(msgs []data.Message) error {
+		for _, msg := range msgs {
+			if err := encoder.Encode(msg); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return writer.Flush()
+}
+
+func (s *raftSnapshot) Release() {
+	s.snapshot.Release()
+}
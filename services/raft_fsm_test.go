@@ -0,0 +1,97 @@
+package services
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"geo-distributed-message-broker/config"
+	"geo-distributed-message-broker/data"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+type testSnapshotSink struct {
+	bytes.Buffer
+	canceled bool
+}
+
+func (s *testSnapshotSink) ID() string   { return "test" }
+func (s *testSnapshotSink) Close() error { return nil }
+func (s *testSnapshotSink) Cancel() error {
+	s.canceled = true
+	return nil
+}
+
+func TestRaftSnapshotIsPointInTime(t *testing.T) {
+	b := newTestBrokerService(t, config.Config{})
+	f := &raftFSM{broker: b, repo: b.repo}
+
+	before := data.Message{ID: "m1", Topic: "orders", Timestamp: 1}
+	if err := b.Store(context.Background(), []data.Message{before}); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshot, err := f.Snapshot()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer snapshot.Release()
+
+	// Messages stored after the snapshot was taken are not part of it
+	after := data.Message{ID: "m2", Topic: "orders", Timestamp: 2}
+	if err := b.Store(context.Background(), []data.Message{after}); err != nil {
+		t.Fatal(err)
+	}
+
+	sink := &testSnapshotSink{}
+	if err := snapshot.Persist(sink); err != nil {
+		t.Fatal(err)
+	}
+
+	var ids []string
+	decoder := json.NewDecoder(&sink.Buffer)
+	for decoder.More() {
+		var msg data.Message
+		if err := decoder.Decode(&msg); err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, msg.ID)
+	}
+	if !reflect.DeepEqual(ids, []string{before.ID}) {
+		t.Errorf("snapshot messages = %v, want [%s]", ids, before.ID)
+	}
+}
+
+func TestRaftApplyTakesDuplicatesFromEntry(t *testing.T) {
+	b := newTestBrokerService(t, config.Config{DeduplicationWindow: time.Minute})
+	f := &raftFSM{broker: b, repo: b.repo}
+
+	// The leader found the second message to be a duplicate of one this node does not know
+	msgs := []data.Message{
+		{ID: "m1", Topic: "orders", Timestamp: 1, IdempotencyKey: "k1"},
+		{ID: "m2", Topic: "orders", Timestamp: 2, IdempotencyKey: "k2"},
+	}
+	entry, err := json.Marshal(raftEntry{Messages: msgs, Duplicates: map[string]string{"m2": "m0"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result := f.Apply(&raft.Log{Index: 1, Data: entry}).(raftApplyResult)
+	if result.err != nil {
+		t.Fatal(result.err)
+	}
+	if want := []string{"m1", "m0"}; !reflect.DeepEqual(result.ids, want) {
+		t.Errorf("Apply() ids = %v, want %v", result.ids, want)
+	}
+
+	existing, err := b.repo.GetExistingIDs([]string{"m1", "m2"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !existing["m1"] || existing["m2"] {
+		t.Errorf("stored messages = %v, want only m1", existing)
+	}
+}
@@ -0,0 +1,100 @@
+package services
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hashicorp/raft"
+)
+
+// raftStreamLayer carries raft traffic over mutual TLS,
+// using the same certificates as the node service.
+type raftStreamLayer struct {
+	net.Listener
+	address   raftAddress
+	members   []string     // raft addresses of the other nodes, the only peers accepted
+	rejected  atomic.Int64 // rejected connections
+	tlsConfig *tls.Config  // client side of outbound connections
+}
+
+type raftAddress string
+
+func (a raftAddress) Network() string {
+	return "tcp"
+}
+
+func (a raftAddress) String() string {
+	return string(a)
+}
+
+func newRaftStreamLayer(port string, address string, members []string, certs *Certificates) (*raftStreamLayer, error) {
+	s := &raftStreamLayer{
+		address:   raftAddress(address),
+		members:   members,
+		tlsConfig: certs.ClientConfig(),
+	}
+
+	// Certificates signed by the CA are only accepted from members
+	serverConfig := certs.ServerConfig(tls.RequireAndVerifyClientCert)
+	getConfig := serverConfig.GetConfigForClient
+	serverConfig.GetConfigForClient = func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		conf, err := getConfig(hello)
+		if err != nil {
+			return nil, err
+		}
+		conf.VerifyConnection = s.verifyPeer
+		return conf, nil
+	}
+
+	listener, err := tls.Listen("tcp", port, serverConfig)
+	if err != nil {
+		return nil, err
+	}
+	s.Listener = listener
+
+	return s, nil
+}
+
+// verifyPeer rejects connections from holders of a valid certificate
+// that are not members of the raft cluster.
+func (s *raftStreamLayer) verifyPeer(cs tls.ConnectionState) error {
+	if len(cs.PeerCertificates) == 0 {
+		return errors.New("client certificate is required")
+	}
+
+	identities := peerIdentities(cs.PeerCertificates[0])
+	for _, member := range s.members {
+		if matchesHost(identities, member) {
+			return nil
+		}
+	}
+
+	peer := strings.Join(identities, ",")
+	if peer == "" {
+		peer = cs.PeerCertificates[0].Subject.String()
+	}
+
+	// Logged sparsely, so a misbehaving peer can not flood the log
+	rejected := s.rejected.Add(1)
+	if rejected == 1 || rejected%PEER_REJECTION_LOG_EVERY == 0 {
+		slog.Warn("Rejected raft connection from unknown peer", "peer", peer, "rejected", rejected)
+	}
+
+	return fmt.Errorf("peer %s is not a member of the raft cluster", peer)
+}
+
+// Addr returns the advertised address instead of the bind address.
+func (s *raftStreamLayer) Addr() net.Addr {
+	return s.address
+}
+
+func (s *raftStreamLayer) Dial(address raft.ServerAddress, timeout time.Duration) (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: timeout}
+	return tls.DialWithDialer(dialer, "tcp", string(address), s.tlsConfig)
+}
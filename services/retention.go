@@ -0,0 +1,121 @@
+package services
+
+import (
+	"geo-distributed-message-broker/config"
+	"geo-distributed-message-broker/data"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+type RetentionService interface {
+	GetPolicy(topic string) data.RetentionPolicy
+	SetPolicy(topic string, policy data.RetentionPolicy)
+}
+
+func NewRetentionService(cfg config.Config, repo data.Repository) RetentionService {
+	slog.Info("Creating new retention service 🧹")
+
+	policies := make(map[string]data.RetentionPolicy)
+	for topic, maxAge := range cfg.TopicRetentionMaxAge {
+		policy := policies[topic]
+		policy.MaxAge = maxAge
+		policies[topic] = policy
+	}
+	for topic, maxBytes := range cfg.TopicRetentionMaxBytes {
+		policy := policies[topic]
+		policy.MaxBytes = int64(maxBytes)
+		policies[topic] = policy
+	}
+	for topic, maxMessages := range cfg.TopicRetentionMaxMessages {
+		policy := policies[topic]
+		policy.MaxMessages = int64(maxMessages)
+		policies[topic] = policy
+	}
+
+	r := &retentionService{
+		defaultPolicy: data.RetentionPolicy{
+			MaxAge:      cfg.RetentionMaxAge,
+			MaxBytes:    int64(cfg.RetentionMaxBytes),
+			MaxMessages: int64(cfg.RetentionMaxMessages),
+		},
+		policies: policies,
+		interval: cfg.RetentionInterval,
+		repo:     repo,
+	}
+	time.AfterFunc(r.interval, r.CleanupJob)
+
+	return r
+}
+
+type retentionService struct {
+	defaultPolicy data.RetentionPolicy
+	policies      map[string]data.RetentionPolicy // map[topic_name]data.RetentionPolicy
+	mu            sync.RWMutex                    // protects defaultPolicy and policies
+	interval      time.Duration
+	repo          data.Repository
+}
+
+// GetPolicy returns the policy of a topic, or the default policy for an empty topic.
+func (r *retentionService) GetPolicy(topic string) data.RetentionPolicy {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	if policy, ok := r.policies[topic]; ok {
+		return policy
+	}
+
+	return r.defaultPolicy
+}
+
+// SetPolicy sets the policy of a topic, or the default policy for an empty topic.
+func (r *retentionService) SetPolicy(topic string, policy data.RetentionPolicy) {
+	slog.Info("Setting retention policy", "topic", topic, "max_age", policy.MaxAge, "max_bytes", policy.MaxBytes, "max_messages", policy.MaxMessages)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if topic == "" {
+		r.defaultPolicy = policy
+		return
+	}
+
+	r.policies[topic] = policy
+}
+
+func (r *retentionService) CleanupJob() {
+	defer time.AfterFunc(r.interval, r.CleanupJob)
+
+	topics, err := r.repo.GetTopics()
+	if err != nil {
+		slog.Error("Failed to get topics for retention", "error", err.Error())
+		return
+	}
+
+	for _, topic := range topics {
+		policy := r.GetPolicy(topic)
+		if policy == (data.RetentionPolicy{}) {
+			continue
+		}
+
+		messagesRemoved, err := r.repo.DeleteMessages(topic, policy)
+		if err != nil {
+			slog.Error("Failed to apply retention policy", "topic", topic, "error", err.Error())
+			continue
+		}
+
+		if messagesRemoved > 0 {
+			slog.Info("Retention job finished", "topic", topic, "messages_removed", messagesRemoved)
+		}
+	}
+
+	// Forget delivery attempts of removed messages
+	deliveriesRemoved, err := r.repo.DeleteStaleDeliveries()
+	if err != nil {
+		slog.Error("Failed to delete stale delivery attempts", "error", err.Error())
+		return
+	}
+	if deliveriesRemoved > 0 {
+		slog.Info("Removed delivery attempts of deleted messages", "deliveries_removed", deliveriesRemoved)
+	}
+}
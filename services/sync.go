@@ -0,0 +1,283 @@
+package services
+
+import (
+	"context"
+	"errors"
+	"geo-distributed-message-broker/data"
+	"geo-distributed-message-broker/models"
+	"hash/fnv"
+	"log/slog"
+	"time"
+)
+
+// SYNC_BUCKET is the width of the timestamp ranges whose digests are compared.
+const SYNC_BUCKET = 1 * time.Minute
+
+// SYNC_HORIZON keeps anti-entropy away from recent messages, which may still
+// be waiting for their predecessors to be published by consensus.
+const SYNC_HORIZON = 3 * MESSAGE_TTL
+
+// SYNC_PULL_MAX_BYTES limits the size of the bodies returned by a pull.
+const SYNC_PULL_MAX_BYTES = 1 << 20
+
+type bucketKey struct {
+	topic string
+	from  int64
+}
+
+// Digest summarizes the stored messages by topic and bucket of timestamps.
+func (c *consensusService) Digest(ctx context.Context, req models.DigestRequest) (models.DigestResponse, error) {
+	if req.Bucket <= 0 {
+		return models.DigestResponse{}, errors.New("bucket width must be positive")
+	}
+
+	msgs, err := c.repo.GetMessageStamps(ctx, req.From, req.To)
+	if err != nil {
+		return models.DigestResponse{}, err
+	}
+
+	digests, _ := summarize(msgs, req.Bucket)
+
+	rsp := models.DigestResponse{
+		Digests: make([]models.Digest, 0, len(digests)),
+	}
+	for _, digest := range digests {
+		rsp.Digests = append(rsp.Digests, *digest)
+	}
+
+	return rsp, nil
+}
+
+// Pull returns the stored messages of a bucket the puller does not have.
+func (c *consensusService) Pull(ctx context.Context, req models.PullRequest) (models.PullResponse, error) {
+	msgs, err := c.repo.GetMessagesBetween(ctx, req.Topic, req.From, req.To)
+	if err != nil {
+		return models.PullResponse{}, err
+	}
+
+	known := make(map[string]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		known[id] = true
+	}
+
+	rsp := models.PullResponse{}
+	size := 0
+	for _, msg := range msgs {
+		if known[msg.ID] {
+			continue
+		}
+
+		// Always return at least one message, so the puller makes progress
+		if size > 0 && size+len(msg.Body) > SYNC_PULL_MAX_BYTES {
+			rsp.More = true
+			break
+		}
+
+		size += len(msg.Body)
+		rsp.Messages = append(rsp.Messages, msg)
+	}
+
+	return rsp, nil
+}
+
+// SyncJob pulls the messages this node missed from every other node,
+// e.g. stable requests lost while it was down or partitioned.
+func (c *consensusService) SyncJob() {
+	defer time.AfterFunc(c.syncInterval, c.SyncJob)
+
+	now := time.Now()
+	bucket := SYNC_BUCKET.Microseconds()
+	from := now.Add(-c.syncWindow).UnixMicro()
+	if !c.synced {
+		from = min(from, c.syncFrom)
+	}
+	from -= from % bucket // nodes must agree on bucket boundaries
+	to := now.Add(-SYNC_HORIZON).UnixMicro()
+
+	synced := true
+	nodes, _ := c.members()
+	for host, node := range c.detector.filter(nodes) {
+		pulled, err := c.sync(context.Background(), node, from, to)
+		if pulled > 0 {
+			slog.Info("Pulled missing messages from node", "node", host, "messages", pulled)
+		}
+		if err != nil {
+			slog.Warn("Failed to sync with node", "node", host, "error", err.Error())
+			synced = false
+		}
+	}
+
+	if synced && len(nodes) > 0 {
+		c.synced = true
+	}
+}
+
+// sync compares digests with the node and pulls the buckets that differ,
+// messages the node is missing are pulled by the node itself.
+func (c *consensusService) sync(ctx context.Context, node Node, from int64, to int64) (int, error) {
+	bucket := SYNC_BUCKET.Microseconds()
+
+	msgs, err := c.repo.GetMessageStamps(ctx, from, to)
+	if err != nil {
+		return 0, err
+	}
+	local, ids := summarize(msgs, bucket)
+
+	digestCtx, cancel := context.WithTimeout(ctx, c.nodeTimeout)
+	defer cancel()
+
+	rsp, err := node.Digest(digestCtx, models.DigestRequest{
+		From:   from,
+		To:     to,
+		Bucket: bucket,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	pulled := 0
+	horizons := make(map[string]int64) // map[topic_name]retention_horizon
+	for _, remote := range rsp.Digests {
+		key := bucketKey{topic: remote.Topic, from: remote.From}
+		if digest, ok := local[key]; ok && digest.Count == remote.Count && digest.Hash == remote.Hash {
+			continue
+		}
+
+		// Messages this node's retention policy deleted are not pulled again
+		horizon, ok := horizons[remote.Topic]
+		if !ok {
+			horizon, err = c.retentionHorizon(remote.Topic)
+			if err != nil {
+				return pulled, err
+			}
+			horizons[remote.Topic] = horizon
+		}
+
+		bucketTo := min(remote.From+bucket, to)
+		if bucketTo <= horizon {
+			continue
+		}
+
+		n, err := c.pull(ctx, node, remote.Topic, max(remote.From, horizon), bucketTo, ids[key])
+		pulled += n
+		if err != nil {
+			return pulled, err
+		}
+	}
+
+	return pulled, nil
+}
+
+func (c *consensusService) pull(ctx context.Context, node Node, topic string, from int64, to int64, ids []string) (int, error) {
+	pulled := 0
+	for {
+		pullCtx, cancel := context.WithTimeout(ctx, c.nodeTimeout)
+		rsp, err := node.Pull(pullCtx, models.PullRequest{
+			Topic: topic,
+			From:  from,
+			To:    to,
+			IDs:   ids,
+		})
+		cancel()
+		if err != nil {
+			return pulled, err
+		}
+
+		for _, msg := range rsp.Messages {
+			ids = append(ids, msg.ID)
+		}
+
+		// Skip messages published by consensus since the digests were compared
+		missing, err := c.withoutExisting(rsp.Messages)
+		if err != nil {
+			return pulled, err
+		}
+
+		if len(missing) > 0 {
+			// Missing messages are older than what live subscribers already got,
+			// they are only stored for subscribers replaying the topic
+			if err := c.broker.Store(ctx, missing); err != nil {
+				return pulled, err
+			}
+
+			pulled += len(missing)
+		}
+
+		if !rsp.More {
+			return pulled, nil
+		}
+	}
+}
+
+// retentionHorizon returns the timestamp before which the retention policy
+// of this node deletes messages of the topic, or 0 if it deletes none.
+func (c *consensusService) retentionHorizon(topic string) (int64, error) {
+	if c.retention == nil {
+		return 0, nil
+	}
+
+	policy := c.retention.GetPolicy(topic)
+	if policy == (data.RetentionPolicy{}) {
+		return 0, nil
+	}
+
+	return c.repo.GetRetentionHorizon(topic, policy)
+}
+
+func (c *consensusService) withoutExisting(msgs []data.Message) ([]data.Message, error) {
+	if len(msgs) == 0 {
+		return msgs, nil
+	}
+
+	ids := make([]string, len(msgs))
+	for i, msg := range msgs {
+		ids[i] = msg.ID
+	}
+
+	existing, err := c.repo.GetExistingIDs(ids)
+	if err != nil {
+		return nil, err
+	}
+
+	missing := make([]data.Message, 0, len(msgs))
+	for _, msg := range msgs {
+		if !existing[msg.ID] {
+			missing = append(missing, msg)
+		}
+	}
+
+	return missing, nil
+}
+
+// summarize returns the digests of the messages by topic and bucket,
+// and the IDs of the messages in every bucket.
+func summarize(msgs []data.Message, bucket int64) (map[bucketKey]*models.Digest, map[bucketKey][]string) {
+	digests := make(map[bucketKey]*models.Digest)
+	ids := make(map[bucketKey][]string)
+
+	for _, msg := range msgs {
+		key := bucketKey{topic: msg.Topic, from: msg.Timestamp - msg.Timestamp%bucket}
+
+		digest, ok := digests[key]
+		if !ok {
+			digest = &models.Digest{
+				Topic: key.topic,
+				From:  key.from,
+			}
+			digests[key] = digest
+		}
+
+		digest.Count++
+		digest.Hash ^= hashID(msg.ID)
+		ids[key] = append(ids[key], msg.ID)
+	}
+
+	return digests, ids
+}
+
+func hashID(id string) uint64 {
+	h := fnv.New64a()
+	h.Write([]byte(id))
+
+	return h.Sum64()
+}
@@ -1,8 +1,10 @@
 package services
 
 import (
+	"context"
 	"geo-distributed-message-broker/data"
 	"log/slog"
+	"slices"
 	"sync"
 	"time"
 )
@@ -14,16 +16,23 @@ type Messages map[string]data.Message // map[message_id]data.Message
 
 type Topic interface {
 	GetMessages(states ...string) Messages
+	GetState(id string) string
 	UpsertMessage(msg data.Message, state string, predecessors Messages) bool
-	WaitForStateUpdate(predecessors Messages, states ...string) Messages
+	WaitForStateUpdate(ctx context.Context, predecessors Messages, states ...string) (Messages, error)
 }
 
 func NewTopic(name string) Topic {
+	return newTopic(name, nil)
+}
+
+// newTopic creates a topic recording its state transitions in log, if not nil.
+func newTopic(name string, log *consensusLog) *topic {
 	slog.Info("Creating new topic 🗃️", "name", name)
 
 	t := &topic{
 		name:     name,
 		messages: make(map[string]MessageTuple),
+		log:      log,
 	}
 	time.AfterFunc(MESSAGE_CLEANUP, t.CleanupJob)
 
@@ -34,6 +43,7 @@ type topic struct {
 	name     string
 	messages map[string]MessageTuple // map[message_id]MessageTuple
 	mu       sync.RWMutex            // protects messages
+	log      *consensusLog
 }
 
 const (
@@ -55,6 +65,7 @@ type MessageTuple struct {
 
 type WaitResult struct {
 	State        string
+	Timestamp    int64
 	Predecessors Messages
 }
 
@@ -64,6 +75,12 @@ func (t *MessageTuple) createWaitChannel() chan WaitResult {
 	return waitChan
 }
 
+func (t *MessageTuple) removeWaitChannel(waitChan chan WaitResult) {
+	t.waitChannels = slices.DeleteFunc(t.waitChannels, func(w chan WaitResult) bool {
+		return w == waitChan
+	})
+}
+
 func (t *MessageTuple) broadcastWaitResult() {
 	if len(t.waitChannels) == 0 {
 		return
@@ -71,11 +88,17 @@ func (t *MessageTuple) broadcastWaitResult() {
 
 	result := WaitResult{
 		State:        t.state,
+		Timestamp:    t.message.Timestamp,
 		Predecessors: t.predecessors,
 	}
 
+	// The caller holds the topic's lock, which a canceled waiter takes to remove
+	// its channel, so a full channel of a waiter that stopped reading is skipped
 	for _, w := range t.waitChannels {
-		w <- result
+		select {
+		case w <- result:
+		default:
+		}
 	}
 }
 
@@ -127,6 +150,14 @@ func (t *topic) GetMessages(states ...string) Messages {
 	return messages
 }
 
+// GetState returns the state of the message, or an empty string if it is unknown.
+func (t *topic) GetState(id string) string {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+
+	return t.messages[id].state
+}
+
 func (t *topic) UpsertMessage(msg data.Message, state string, predecessors Messages) bool {
 	t.mu.Lock()
 	defer t.mu.Unlock()
@@ -134,11 +165,13 @@ func (t *topic) UpsertMessage(msg data.Message, state string, predecessors Messa
 	tuple, ok := t.messages[msg.ID]
 	if !ok {
 		// If no message exists, create a new one
+		expire := time.Now().Add(MESSAGE_TTL).Unix()
+		t.logTransition(msg, state, predecessors, expire)
 		tuple.message = msg
 		tuple.state = state
 		tuple.predecessors = predecessors
 		tuple.waitChannels = []chan WaitResult{}
-		tuple.expire = time.Now().Add(MESSAGE_TTL).Unix()
+		tuple.expire = expire
 		t.messages[msg.ID] = tuple
 		return true
 	}
@@ -153,6 +186,11 @@ func (t *topic) UpsertMessage(msg data.Message, state string, predecessors Messa
 	}
 
 	if state == ProposedState {
+		// A proposal aborted before it arrived stays aborted, retries have other timestamps
+		if tuple.state == NackState && tuple.message.Timestamp == msg.Timestamp {
+			return false
+		}
+
 		tuple.state = NackState
 		tuple.broadcastWaitResult()
 
@@ -165,6 +203,10 @@ func (t *topic) UpsertMessage(msg data.Message, state string, predecessors Messa
 		return true
 	}
 
+	t.logTransition(msg, state, predecessors, tuple.expire)
+
+	// Stable messages carry the agreed timestamp, which may be newer than the proposed one
+	tuple.message.Timestamp = msg.Timestamp
 	tuple.state = state
 	tuple.predecessors = predecessors
 	tuple.broadcastWaitResult()
@@ -172,9 +214,68 @@ func (t *topic) UpsertMessage(msg data.Message, state string, predecessors Messa
 	return false
 }
 
-func (t *topic) WaitForStateUpdate(messages Messages, states ...string) Messages {
+// logTransition writes the transition to the consensus log, proposals are
+// not logged because they are not acknowledged to anyone yet.
+func (t *topic) logTransition(msg data.Message, state string, predecessors Messages, expire int64) {
+	if state == ProposedState {
+		return
+	}
+
+	if t.log == nil {
+		return
+	}
+
+	record := logRecord{
+		Message: msg,
+		State:   state,
+		Expire:  expire,
+	}
+
+	// Only stable messages need their body and the predecessors
+	// they still wait for to be published after a restart
+	if state == StableState {
+		record.Predecessors = make(map[string]int64)
+		for id, predecessor := range predecessors {
+			if tuple, ok := t.messages[id]; ok && tuple.state != PublishedState {
+				record.Predecessors[id] = predecessor.Timestamp
+			}
+		}
+	} else {
+		record.Message.Body = nil
+	}
+
+	t.log.Append(record)
+}
+
+// restore rebuilds the messages of the topic from consensus log records.
+func (t *topic) restore(records []logRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for _, record := range records {
+		// Stable messages may have expired while the node was down,
+		// they are kept until they are published again
+		expire := record.Expire
+		if record.State == StableState {
+			expire = max(expire, time.Now().Add(MESSAGE_TTL).Unix())
+		}
+
+		t.messages[record.Message.ID] = MessageTuple{
+			message:      record.Message,
+			predecessors: record.predecessors(),
+			waitChannels: []chan WaitResult{},
+			state:        record.State,
+			expire:       expire,
+		}
+	}
+}
+
+// WaitForStateUpdate waits until the messages reach one of the states or an
+// end state, and returns their predecessors. If ctx is done first, the waiters
+// are released and the predecessors collected so far are returned with its error.
+func (t *topic) WaitForStateUpdate(ctx context.Context, messages Messages, states ...string) (Messages, error) {
 	if len(messages) == 0 {
-		return messages
+		return messages, nil
 	}
 
 	endStatesMap := map[string]bool{
@@ -199,6 +300,11 @@ func (t *topic) WaitForStateUpdate(messages Messages, states ...string) Messages
 				continue
 			}
 
+			// Message was proposed again with another timestamp, so the awaited proposal is gone
+			if tuple.message.Timestamp != msg.Timestamp {
+				continue
+			}
+
 			if _, ok := desiredStatesMap[tuple.state]; ok {
 				for id, msg := range tuple.predecessors {
 					predecessors[id] = msg
@@ -208,20 +314,31 @@ func (t *topic) WaitForStateUpdate(messages Messages, states ...string) Messages
 
 			wg.Add(1)
 			waitChan := tuple.createWaitChannel()
-			go func() {
-				for result := range waitChan {
-					if _, ok := endStatesMap[result.State]; ok {
-						wg.Done()
-						return
-					}
-
-					if _, ok := desiredStatesMap[result.State]; ok {
-						waitResultsChan <- result
-						wg.Done()
+			go func(id string, timestamp int64) {
+				defer wg.Done()
+				for {
+					select {
+					case result := <-waitChan:
+						if _, ok := endStatesMap[result.State]; ok || result.Timestamp != timestamp {
+							return
+						}
+
+						if _, ok := desiredStatesMap[result.State]; ok {
+							waitResultsChan <- result
+							return
+						}
+
+					case <-ctx.Done():
+						t.mu.Lock()
+						if tuple, ok := t.messages[id]; ok {
+							tuple.removeWaitChannel(waitChan)
+							t.messages[id] = tuple
+						}
+						t.mu.Unlock()
 						return
 					}
 				}
-			}()
+			}(msg.ID, msg.Timestamp)
 			t.messages[msg.ID] = tuple
 		}
 	}
@@ -235,5 +352,5 @@ func (t *topic) WaitForStateUpdate(messages Messages, states ...string) Messages
 		}
 	}
 
-	return predecessors
+	return predecessors, ctx.Err()
 }
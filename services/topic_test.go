@@ -0,0 +1,108 @@
+package services
+
+import (
+	"context"
+	"geo-distributed-message-broker/data"
+	"testing"
+	"time"
+)
+
+func TestWaitForStateUpdate(t *testing.T) {
+	topic := newTopic("orders", nil)
+	msg := data.Message{ID: "m1", Topic: "orders", Timestamp: 1}
+	topic.UpsertMessage(msg, ProposedState, make(Messages))
+
+	predecessor := data.Message{ID: "m0", Topic: "orders", Timestamp: 0}
+	done := make(chan Messages)
+	go func() {
+		predecessors, err := topic.WaitForStateUpdate(context.Background(), Messages{msg.ID: msg}, StableState)
+		if err != nil {
+			t.Error(err)
+		}
+		done <- predecessors
+	}()
+
+	// Wait for the waiter to register before the message becomes stable
+	time.Sleep(10 * time.Millisecond)
+	topic.UpsertMessage(msg, AckState, make(Messages))
+	topic.UpsertMessage(msg, StableState, Messages{predecessor.ID: predecessor})
+
+	select {
+	case predecessors := <-done:
+		if _, ok := predecessors[predecessor.ID]; !ok || len(predecessors) != 1 {
+			t.Errorf("predecessors = %v, want %s", predecessors, predecessor.ID)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("waiter was not released by the stable state")
+	}
+}
+
+func TestWaitForStateUpdateCanceled(t *testing.T) {
+	topic := newTopic("orders", nil)
+	msg := data.Message{ID: "m1", Topic: "orders", Timestamp: 1}
+	topic.UpsertMessage(msg, ProposedState, make(Messages))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error)
+	go func() {
+		_, err := topic.WaitForStateUpdate(ctx, Messages{msg.ID: msg}, StableState)
+		waited <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	// Updates keep coming while the canceled waiter removes its channel,
+	// more than its channel buffers
+	cancel()
+	updated := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			topic.UpsertMessage(msg, AckState, make(Messages))
+		}
+		close(updated)
+	}()
+
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("state updates blocked on a canceled waiter")
+	}
+
+	select {
+	case err := <-waited:
+		if err != context.Canceled {
+			t.Errorf("WaitForStateUpdate() error = %v, want %v", err, context.Canceled)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("canceled waiter did not return")
+	}
+}
+
+func TestWaitForStateUpdateFinished(t *testing.T) {
+	topic := newTopic("orders", nil)
+	msg := data.Message{ID: "m1", Topic: "orders", Timestamp: 1}
+	topic.UpsertMessage(msg, ProposedState, make(Messages))
+
+	waited := make(chan struct{})
+	go func() {
+		topic.WaitForStateUpdate(context.Background(), Messages{msg.ID: msg}, AckState)
+		close(waited)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	topic.UpsertMessage(msg, AckState, make(Messages))
+	<-waited
+
+	// The waiter returned but its channel is still registered
+	updated := make(chan struct{})
+	go func() {
+		for i := 0; i < 100; i++ {
+			topic.UpsertMessage(msg, AckState, make(Messages))
+		}
+		close(updated)
+	}()
+
+	select {
+	case <-updated:
+	case <-time.After(time.Second):
+		t.Fatal("state updates blocked on a finished waiter")
+	}
+}
@@ -0,0 +1,72 @@
+package services
+
+import (
+	"geo-distributed-message-broker/models"
+	"sort"
+)
+
+// GetTopology returns the voting nodes clients can connect to, nearest first:
+// this node, then alive nodes of its region, then the others by round trip.
+func (c *consensusService) GetTopology() ([]models.Endpoint, error) {
+	membership := c.membership()
+	health := c.detector.Health()
+
+	endpoints := make([]models.Endpoint, 0, len(membership.Nodes))
+	for _, host := range membership.Nodes {
+		if host == c.address {
+			endpoints = append(endpoints, models.Endpoint{
+				Node:          host,
+				BrokerAddress: c.info.BrokerAddress,
+				Region:        membership.Regions[host],
+				Zone:          c.info.Zone,
+				Alive:         true,
+			})
+			continue
+		}
+
+		endpoint := models.Endpoint{
+			Node:   host,
+			Region: membership.Regions[host],
+			Alive:  true,
+		}
+
+		// Nodes report their broker address and zone in heartbeats
+		if h, ok := health[host]; ok {
+			endpoint.BrokerAddress = h.Info.BrokerAddress
+			endpoint.Zone = h.Info.Zone
+			endpoint.Alive = h.Alive
+			endpoint.RTT = h.RTT
+			if endpoint.Region == "" {
+				endpoint.Region = h.Info.Region
+			}
+		}
+
+		endpoints = append(endpoints, endpoint)
+	}
+
+	region := membership.Regions[c.address]
+	sort.SliceStable(endpoints, func(i, j int) bool {
+		return nearer(endpoints[i], endpoints[j], c.address, region)
+	})
+
+	return endpoints, nil
+}
+
+// nearer reports whether endpoint a is nearer to this node than endpoint b,
+// nodes with an unknown round trip come after the measured ones.
+func nearer(a models.Endpoint, b models.Endpoint, self string, region string) bool {
+	if (a.Node == self) != (b.Node == self) {
+		return a.Node == self
+	}
+	if a.Alive != b.Alive {
+		return a.Alive
+	}
+	if (a.Region == region) != (b.Region == region) {
+		return a.Region == region
+	}
+	if (a.RTT == 0) != (b.RTT == 0) {
+		return b.RTT == 0
+	}
+
+	return a.RTT < b.RTT
+}
@@ -0,0 +1,64 @@
+package services
+
+import "strings"
+
+const (
+	SINGLE_WILDCARD = "*" // matches exactly one topic token
+	MULTI_WILDCARD  = ">" // matches one or more trailing topic tokens
+)
+
+// IsWildcard reports whether the topic is a pattern over dot separated
+// topic tokens, e.g. "orders.*.created" or "orders.>".
+func IsWildcard(topic string) bool {
+	for _, token := range strings.Split(topic, ".") {
+		if token == SINGLE_WILDCARD || token == MULTI_WILDCARD {
+			return true
+		}
+	}
+
+	return false
+}
+
+func MatchTopic(pattern string, topic string) bool {
+	patternTokens := strings.Split(pattern, ".")
+	topicTokens := strings.Split(topic, ".")
+
+	for i, token := range patternTokens {
+		if token == MULTI_WILDCARD && i == len(patternTokens)-1 {
+			return len(topicTokens) > i
+		}
+
+		if i >= len(topicTokens) {
+			return false
+		}
+
+		if token != SINGLE_WILDCARD && token != topicTokens[i] {
+			return false
+		}
+	}
+
+	return len(patternTokens) == len(topicTokens)
+}
+
+// CoversTopic reports whether every topic matched by pattern is also matched
+// by grant, e.g. "orders.>" covers "orders.*.created" but not "*.eu.created".
+func CoversTopic(grant string, pattern string) bool {
+	grantTokens := strings.Split(grant, ".")
+	patternTokens := strings.Split(pattern, ".")
+
+	for i, token := range grantTokens {
+		if token == MULTI_WILDCARD && i == len(grantTokens)-1 {
+			return len(patternTokens) > i
+		}
+
+		if i >= len(patternTokens) || patternTokens[i] == MULTI_WILDCARD {
+			return false
+		}
+
+		if token != SINGLE_WILDCARD && token != patternTokens[i] {
+			return false
+		}
+	}
+
+	return len(grantTokens) == len(patternTokens)
+}
@@ -0,0 +1,84 @@
+package services
+
+import "testing"
+
+func TestIsWildcard(t *testing.T) {
+	tests := []struct {
+		topic string
+		want  bool
+	}{
+		{topic: "orders", want: false},
+		{topic: "orders.created", want: false},
+		{topic: "orders.*", want: true},
+		{topic: "orders.>", want: true},
+		{topic: "*.created", want: true},
+		{topic: "orders.a*", want: false},
+		{topic: "orders.>x", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := IsWildcard(tt.topic); got != tt.want {
+			t.Errorf("IsWildcard(%s) = %v, want %v", tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestMatchTopic(t *testing.T) {
+	tests := []struct {
+		pattern string
+		topic   string
+		want    bool
+	}{
+		{pattern: "orders", topic: "orders", want: true},
+		{pattern: "orders", topic: "payments", want: false},
+		{pattern: "orders.*", topic: "orders.created", want: true},
+		{pattern: "orders.*", topic: "orders", want: false},
+		{pattern: "orders.*", topic: "orders.eu.created", want: false},
+		{pattern: "orders.*.created", topic: "orders.eu.created", want: true},
+		{pattern: "orders.*.created", topic: "orders.eu.deleted", want: false},
+		{pattern: "*.created", topic: "orders.created", want: true},
+		{pattern: "orders.>", topic: "orders.created", want: true},
+		{pattern: "orders.>", topic: "orders.eu.created", want: true},
+		{pattern: "orders.>", topic: "orders", want: false},
+		{pattern: "orders.>", topic: "payments.created", want: false},
+		{pattern: ">", topic: "orders", want: true},
+		{pattern: "*.>", topic: "orders", want: false},
+		{pattern: "*.>", topic: "orders.created", want: true},
+		{pattern: "orders.>.created", topic: "orders.eu.created", want: false},
+	}
+
+	for _, tt := range tests {
+		if got := MatchTopic(tt.pattern, tt.topic); got != tt.want {
+			t.Errorf("MatchTopic(%s, %s) = %v, want %v", tt.pattern, tt.topic, got, tt.want)
+		}
+	}
+}
+
+func TestCoversTopic(t *testing.T) {
+	tests := []struct {
+		grant   string
+		pattern string
+		want    bool
+	}{
+		{grant: "orders", pattern: "orders", want: true},
+		{grant: "orders", pattern: "orders.*", want: false},
+		{grant: "orders.*", pattern: "orders.created", want: true},
+		{grant: "orders.*", pattern: "orders.*", want: true},
+		{grant: "orders.*", pattern: "orders.>", want: false},
+		{grant: "orders.created", pattern: "orders.*", want: false},
+		{grant: "orders.>", pattern: "orders.*.created", want: true},
+		{grant: "orders.>", pattern: "orders.>", want: true},
+		{grant: "orders.>", pattern: "orders", want: false},
+		{grant: "orders.>", pattern: "*.eu.created", want: false},
+		{grant: "*.*.created", pattern: "orders.*.created", want: true},
+		{grant: "*.*.created", pattern: "orders.>", want: false},
+		{grant: ">", pattern: ">", want: true},
+		{grant: ">", pattern: "orders.*", want: true},
+	}
+
+	for _, tt := range tests {
+		if got := CoversTopic(tt.grant, tt.pattern); got != tt.want {
+			t.Errorf("CoversTopic(%s, %s) = %v, want %v", tt.grant, tt.pattern, got, tt.want)
+		}
+	}
+}
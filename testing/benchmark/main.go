@@ -0,0 +1,307 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"geo-distributed-message-broker/config"
+	"geo-distributed-message-broker/data"
+	"geo-distributed-message-broker/models"
+	"geo-distributed-message-broker/services"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"gorm.io/gorm"
+)
+
+// Benchmark of publishing to a single hot topic on an in-process cluster,
+// with and without pipelined consensus rounds.
+func main() {
+	nodes := flag.Int("nodes", 3, "number of nodes in the cluster")
+	publishers := flag.Int("publishers", 64, "number of concurrent publishers")
+	messages := flag.Int("messages", 5000, "number of messages to publish")
+	size := flag.Int("size", 256, "size of a message body in bytes")
+	latency := flag.Duration("latency", 2*time.Millisecond, "one-way latency between nodes")
+	depth := flag.Int("depth", 4, "pipelined rounds in flight per topic")
+	maxBatch := flag.Int("batch", 100, "max messages in a pipelined round")
+	flag.Parse()
+
+	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError})))
+
+	cfg, err := config.NewConfig()
+	if err != nil {
+		slog.Error("Failed to load config", "error", err.Error())
+		return
+	}
+	cfg.PipelineMaxBatch = *maxBatch
+
+	// Jobs of finished clusters keep running, so their files are removed at the end
+	dir, err := os.MkdirTemp("", "benchmark")
+	if err != nil {
+		slog.Error("Failed to create benchmark directory", "error", err.Error())
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	fmt.Printf("%d nodes, %d publishers, %d messages of %d bytes, %v latency\n\n", *nodes, *publishers, *messages, *size, *latency)
+	fmt.Printf("%-10s %12s %12s %12s %12s %8s\n", "mode", "msg/s", "p50", "p99", "max", "failed")
+
+	for _, mode := range []struct {
+		name  string
+		depth int
+	}{
+		{"unbatched", 0},
+		{"pipelined", *depth},
+	} {
+		cfg.PipelineDepth = mode.depth
+
+		r, err := run(cfg, filepath.Join(dir, mode.name), *nodes, *publishers, *messages, *size, *latency)
+		if err != nil {
+			slog.Error("Failed to run benchmark", "mode", mode.name, "error", err.Error())
+			return
+		}
+
+		fmt.Printf("%-10s %12.0f %12v %12v %12v %8d\n", mode.name, r.throughput, r.percentile(0.50), r.percentile(0.99), r.percentile(1), r.failed)
+	}
+}
+
+type result struct {
+	throughput float64
+	latencies  []time.Duration // sorted
+	failed     int
+}
+
+func (r result) percentile(p float64) time.Duration {
+	if len(r.latencies) == 0 {
+		return 0
+	}
+
+	i := int(p*float64(len(r.latencies))) - 1
+	if i < 0 {
+		i = 0
+	}
+
+	return r.latencies[i].Round(time.Microsecond)
+}
+
+func run(cfg config.Config, dir string, nodes int, publishers int, messages int, size int, latency time.Duration) (result, error) {
+	if err := os.Mkdir(dir, 0700); err != nil {
+		return result{}, err
+	}
+
+	cluster, dbs, err := newCluster(cfg, dir, nodes, latency)
+	if err != nil {
+		return result{}, err
+	}
+	defer func() {
+		for _, db := range dbs {
+			data.CloseDB(db)
+		}
+	}()
+
+	body := make([]byte, size)
+	latencies := make([]time.Duration, 0, messages)
+	failed := 0
+	var mu sync.Mutex // protects latencies and failed
+	var wg sync.WaitGroup
+
+	start := time.Now()
+	for p := 0; p < publishers; p++ {
+		wg.Add(1)
+		go func(p int) {
+			defer wg.Done()
+
+			// Spread publishers over the nodes, so their rounds conflict
+			consensus := cluster[p%nodes]
+			for i := p; i < messages; i += publishers {
+				begin := time.Now()
+				_, err := consensus.Publish(context.Background(), data.Message{
+					Topic: "benchmark",
+					Body:  body,
+				})
+				elapsed := time.Since(begin)
+
+				mu.Lock()
+				if err != nil {
+					failed++
+				} else {
+					latencies = append(latencies, elapsed)
+				}
+				mu.Unlock()
+			}
+		}(p)
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+
+	// Let stable requests sent in the background finish before closing the databases
+	time.Sleep(time.Second)
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+
+	return result{
+		throughput: float64(len(latencies)) / elapsed.Seconds(),
+		latencies:  latencies,
+		failed:     failed,
+	}, nil
+}
+
+func newCluster(cfg config.Config, dir string, n int, latency time.Duration) ([]services.ConsensusService, []*gorm.DB, error) {
+	cluster := make([]services.ConsensusService, n)
+	peers := make([]map[string]services.Node, n)
+	dbs := make([]*gorm.DB, 0, n)
+
+	for i := 0; i < n; i++ {
+		cfg.Database = filepath.Join(dir, fmt.Sprintf("node-%d.db", i))
+		cfg.ConsensusLog = filepath.Join(dir, fmt.Sprintf("node-%d.wal", i))
+		db, err := data.NewDB(cfg)
+		if err != nil {
+			return nil, dbs, err
+		}
+		dbs = append(dbs, db)
+
+		repo := data.NewRepository(db)
+		broker := services.NewBrokerService(cfg, repo)
+		peers[i] = make(map[string]services.Node)
+		cluster[i] = services.NewConsensusServiceWithNodes(cfg, broker, repo, peers[i])
+	}
+
+	// Connect every node to all the others once they exist
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if i != j {
+				peers[i][fmt.Sprintf("node-%d", j)] = &localNode{
+					consensus: cluster[j],
+					latency:   latency,
+				}
+			}
+		}
+	}
+
+	return cluster, dbs, nil
+}
+
+// localNode calls the consensus service of another in-process node, delaying
+// requests and responses by the network latency and copying them through
+// protobuf like the gRPC node client does.
+type localNode struct {
+	consensus services.ConsensusService
+	latency   time.Duration
+}
+
+func (n *localNode) Close() error {
+	return nil
+}
+
+func (n *localNode) Propose(ctx context.Context, req models.ProposeRequest) (models.ProposeResponse, error) {
+	time.Sleep(n.latency)
+	rsp, err := n.consensus.Propose(ctx, models.ToProposeRequest(req.ToPb()))
+	time.Sleep(n.latency)
+	if err != nil {
+		return models.ProposeResponse{}, err
+	}
+
+	return models.ToProposeResponse(rsp.ToPb()), nil
+}
+
+func (n *localNode) Stable(ctx context.Context, req models.StableRequest) error {
+	time.Sleep(n.latency)
+	err := n.consensus.Stable(ctx, models.ToStableRequest(req.ToPb()))
+	time.Sleep(n.latency)
+
+	return err
+}
+
+func (n *localNode) ProposeBatch(ctx context.Context, req models.ProposeBatchRequest) (models.ProposeBatchResponse, error) {
+	time.Sleep(n.latency)
+	rsp, err := n.consensus.ProposeBatch(ctx, models.ToProposeBatchRequest(req.ToPb()))
+	time.Sleep(n.latency)
+	if err != nil {
+		return models.ProposeBatchResponse{}, err
+	}
+
+	return models.ToProposeBatchResponse(rsp.ToPb()), nil
+}
+
+func (n *localNode) StableBatch(ctx context.Context, req models.StableBatchRequest) error {
+	time.Sleep(n.latency)
+	err := n.consensus.StableBatch(ctx, models.ToStableBatchRequest(req.ToPb()))
+	time.Sleep(n.latency)
+
+	return err
+}
+
+func (n *localNode) Abort(ctx context.Context, req models.AbortRequest) error {
+	time.Sleep(n.latency)
+	err := n.consensus.Abort(ctx, models.ToAbortRequest(req.ToPb()))
+	time.Sleep(n.latency)
+
+	return err
+}
+
+func (n *localNode) Forward(ctx context.Context, req models.ForwardRequest) (models.ForwardResponse, error) {
+	time.Sleep(n.latency)
+	ids, err := n.consensus.PublishBatch(ctx, models.ToForwardRequest(req.ToPb()).Messages)
+	time.Sleep(n.latency)
+	if err != nil {
+		return models.ForwardResponse{}, err
+	}
+
+	return models.ForwardResponse{IDs: ids}, nil
+}
+
+func (n *localNode) Digest(ctx context.Context, req models.DigestRequest) (models.DigestResponse, error) {
+	time.Sleep(n.latency)
+	rsp, err := n.consensus.Digest(ctx, models.ToDigestRequest(req.ToPb()))
+	time.Sleep(n.latency)
+	if err != nil {
+		return models.DigestResponse{}, err
+	}
+
+	return models.ToDigestResponse(rsp.ToPb()), nil
+}
+
+func (n *localNode) Pull(ctx context.Context, req models.PullRequest) (models.PullResponse, error) {
+	time.Sleep(n.latency)
+	rsp, err := n.consensus.Pull(ctx, models.ToPullRequest(req.ToPb()))
+	time.Sleep(n.latency)
+	if err != nil {
+		return models.PullResponse{}, err
+	}
+
+	return models.ToPullResponse(rsp.ToPb()), nil
+}
+
+func (n *localNode) Join(ctx context.Context, req models.Membership) error {
+	time.Sleep(n.latency)
+	err := n.consensus.Join(ctx, models.ToMembership(req.ToPb()))
+	time.Sleep(n.latency)
+
+	return err
+}
+
+func (n *localNode) ProposeMembership(ctx context.Context, req models.Membership) error {
+	time.Sleep(n.latency)
+	err := n.consensus.ProposeMembership(ctx, models.ToMembership(req.ToPb()))
+	time.Sleep(n.latency)
+
+	return err
+}
+
+func (n *localNode) UpdateMembership(ctx context.Context, req models.Membership) error {
+	time.Sleep(n.latency)
+	err := n.consensus.UpdateMembership(ctx, models.ToMembership(req.ToPb()))
+	time.Sleep(n.latency)
+
+	return err
+}
+
+func (n *localNode) Heartbeat(ctx context.Context) (models.NodeInfo, error) {
+	time.Sleep(2 * n.latency)
+
+	return models.NodeInfo{}, nil
+}
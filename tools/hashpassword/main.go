@@ -0,0 +1,27 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"geo-distributed-message-broker/services"
+	"log/slog"
+	"os"
+	"strings"
+)
+
+// Hashes a password read from stdin for the users file.
+func main() {
+	password, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && password == "" {
+		slog.Error("Failed to read password", "error", err.Error())
+		os.Exit(1)
+	}
+
+	hash, err := services.HashPassword(strings.TrimRight(password, "\r\n"))
+	if err != nil {
+		slog.Error("Failed to hash password", "error", err.Error())
+		os.Exit(1)
+	}
+
+	fmt.Println(hash)
+}